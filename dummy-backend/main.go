@@ -12,6 +12,9 @@ import (
 var ID = os.Getenv("SERVER_ID")
 var PORT = os.Getenv("PORT")
 
+// Same as request_id.header in the config of the proxy
+var REQUEST_ID_HEADER = os.Getenv("REQUEST_ID_HEADER")
+
 func main() {
 	// This code will be containerized and we will provide as environment variable the name and the port
 	if ID == "" {
@@ -22,6 +25,10 @@ func main() {
 		PORT = "8080"
 	}
 
+	if REQUEST_ID_HEADER == "" {
+		REQUEST_ID_HEADER = "X-Request-ID"
+	}
+
 	http.HandleFunc("/", handler)
 
 	log.Printf("[%s] Starting dummy backend on port %s...", ID, PORT)
@@ -34,7 +41,8 @@ func main() {
 
 func handler(w http.ResponseWriter, r *http.Request) {
 	//TODO: Provide some kind of restricted access to allow only the reverse proxy to access it.
-	log.Printf("[%s] Received request from %s.", ID, r.RemoteAddr)
+	// The request ID given by the proxy matches this line with the one of the proxy
+	log.Printf("[%s] Received request %s from %s.", ID, r.Header.Get(REQUEST_ID_HEADER), r.RemoteAddr)
 
 	// We can also simulate that the backend has some work by sleeping
 	delay := rand.Intn(10)
@@ -0,0 +1,116 @@
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+)
+
+const (
+	DEFAULT_PATH       string = "logs/access.log"
+	DEFAULT_SYSLOG_TAG string = "goknot"
+)
+
+// Entry is what is known about a request once it has been answered
+type Entry struct {
+	Time           time.Time     `json:"time"`
+	ClientIP       string        `json:"client_ip"`
+	Method         string        `json:"method"`
+	Host           string        `json:"host"`
+	Path           string        `json:"path"` // with the query string
+	Proto          string        `json:"proto"`
+	Status         int           `json:"status"` // sent to the client
+	Bytes          int64         `json:"bytes"`  // of the response body
+	BytesIn        int64         `json:"bytes_in"`
+	Duration       time.Duration `json:"-"`
+	DurationMs     float64       `json:"duration_ms"`
+	Pool           string        `json:"pool"`
+	Upstream       string        `json:"upstream,omitempty"`        // last backend tried, empty if none was
+	UpstreamStatus int           `json:"upstream_status,omitempty"` // 0 if the backend didn't answer
+	RequestID      string        `json:"request_id,omitempty"`
+	Referer        string        `json:"referer,omitempty"`
+	UserAgent      string        `json:"user_agent,omitempty"`
+}
+
+// Logger formats the entries and writes them, one per line, to its sink
+type Logger struct {
+	format Formatter
+	out    io.WriteCloser
+	mux    sync.Mutex
+}
+
+// New builds the logger described by the config, nil when the access log is disabled
+func New(cfg config.AccessLogConfig) (*Logger, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	format, err := NewFormatter(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	var out io.WriteCloser
+	switch cfg.Output {
+	case "", "file":
+		path := cfg.Path
+		if path == "" {
+			path = DEFAULT_PATH
+		}
+		out, err = OpenRotatingFile(path, int64(cfg.MaxSize)<<20, time.Duration(cfg.RotateEvery), cfg.MaxBackups, cfg.Compress)
+	case "stdout":
+		// Closing stdout is not our job
+		out = nopCloser{os.Stdout}
+	case "syslog":
+		out, err = DialSyslog(cfg.SyslogNetwork, cfg.SyslogAddress, cfg.SyslogTag)
+	default:
+		return nil, fmt.Errorf("Unknown access log output %q", cfg.Output)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Logger{format: format, out: out}, nil
+}
+
+// Log writes the entry, a nil logger does nothing
+func (l *Logger) Log(e *Entry) {
+	if l == nil {
+		return
+	}
+	e.DurationMs = float64(e.Duration.Microseconds()) / 1000
+
+	line, err := l.format(e)
+	if err != nil {
+		log.Printf("[AccessLog] Failed to format entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if _, err := l.out.Write(line); err != nil {
+		log.Printf("[AccessLog] Failed to write entry: %v", err)
+	}
+}
+
+// Close flushes and releases the sink
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.out.Close()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
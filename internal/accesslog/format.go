@@ -0,0 +1,90 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Time layout of the Common Log Format
+const CLF_TIME string = "02/Jan/2006:15:04:05 -0700"
+
+// Formatter turns an entry into one line, without the newline
+type Formatter func(e *Entry) ([]byte, error)
+
+// NewFormatter returns the formatter of a named format, anything containing "{{" is taken as a template
+func NewFormatter(format string) (Formatter, error) {
+	switch format {
+	case "", "json":
+		return formatJSON, nil
+	case "common":
+		return formatCommon, nil
+	case "combined":
+		return formatCombined, nil
+	}
+
+	if !strings.Contains(format, "{{") {
+		return nil, fmt.Errorf("Unknown access log format %q", format)
+	}
+	tmpl, err := template.New("access_log").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access log template: %w", err)
+	}
+	return func(e *Entry) ([]byte, error) {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, e); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}, nil
+}
+
+func formatJSON(e *Entry) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// formatCommon writes: client - - [time] "METHOD path proto" status bytes
+func formatCommon(e *Entry) ([]byte, error) {
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	// The request line comes from the client, it must not be able to end the quoted field or the line
+	line := fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %s`,
+		dash(e.ClientIP), e.Time.Format(CLF_TIME), quote(e.Method), quote(e.Path), quote(e.Proto), e.Status, size)
+	return []byte(line), nil
+}
+
+// formatCombined is the common format followed by the referer and the user agent
+func formatCombined(e *Entry) ([]byte, error) {
+	line, _ := formatCommon(e)
+	line = fmt.Appendf(line, ` "%s" "%s"`, quote(dash(e.Referer)), quote(dash(e.UserAgent)))
+	return line, nil
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// quote escapes what would break the double quoted fields, control characters are written as \xhh
+func quote(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' || c == '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,176 @@
+package accesslog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Suffix added to the rotated files, it sorts in chronological order
+const ROTATE_SUFFIX string = "2006-01-02T15-04-05.000"
+
+// RotatingFile is a file that is moved aside when it gets too big or too old.
+// Rotated files are named <path>.<time>, and <path>.<time>.gz once compressed.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64         // in bytes, 0 means no limit
+	Every      time.Duration // 0 means no time based rotation
+	MaxBackups int           // 0 keeps all of them
+	Compress   bool
+
+	file    *os.File
+	size    int64
+	opened  time.Time
+	cleanup sync.Mutex // one compression and pruning at a time
+}
+
+func OpenRotatingFile(path string, maxSize int64, every time.Duration, maxBackups int, compress bool) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		Path:       path,
+		MaxSize:    maxSize,
+		Every:      every,
+		MaxBackups: maxBackups,
+		Compress:   compress,
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// Write is not safe for concurrent use, the Logger serializes the calls
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	if rf.shouldRotate(len(p)) {
+		if err := rf.rotate(); err != nil {
+			// Better keep writing to the big file than losing the entries
+			log.Printf("[AccessLog] Failed to rotate %s: %v", rf.Path, err)
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) Close() error {
+	return rf.file.Close()
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file, rf.size, rf.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (rf *RotatingFile) shouldRotate(next int) bool {
+	if rf.MaxSize > 0 && rf.size > 0 && rf.size+int64(next) > rf.MaxSize {
+		return true
+	}
+	return rf.Every > 0 && time.Since(rf.opened) >= rf.Every
+}
+
+func (rf *RotatingFile) rotate() error {
+	rotated := rf.rotatedName(time.Now())
+	rf.file.Close()
+	if err := os.Rename(rf.Path, rotated); err != nil {
+		// Reopen the current file so writes can go on
+		if openErr := rf.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	// Compressing can take a while, requests shouldn't wait for it
+	go rf.cleanupRotated(rotated)
+	return nil
+}
+
+// rotatedName returns a name no backup has yet, rotations within the same millisecond get a counter.
+// It keeps the names sorted by age: the '_' before it comes after the '.' of a compressed backup.
+func (rf *RotatingFile) rotatedName(now time.Time) string {
+	base := rf.Path + "." + now.Format(ROTATE_SUFFIX)
+	name := base
+	for n := 1; exists(name) || exists(name+".gz"); n++ {
+		name = fmt.Sprintf("%s_%03d", base, n)
+	}
+	return name
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (rf *RotatingFile) cleanupRotated(rotated string) {
+	rf.cleanup.Lock()
+	defer rf.cleanup.Unlock()
+
+	if rf.Compress {
+		if err := compressFile(rotated); err != nil {
+			log.Printf("[AccessLog] Failed to compress %s: %v", rotated, err)
+		}
+	}
+
+	if rf.MaxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(rf.Path + ".*")
+	if err != nil {
+		return
+	}
+	// Names end with the rotation time, the oldest come first
+	slices.Sort(backups)
+	for len(backups) > rf.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			log.Printf("[AccessLog] Failed to remove old log %s: %v", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
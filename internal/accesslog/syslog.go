@@ -0,0 +1,90 @@
+package accesslog
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_SYSLOG_NETWORK string = "unixgram"
+	DEFAULT_SYSLOG_ADDRESS string = "/dev/log"
+
+	// local0.info, see RFC 3164
+	SYSLOG_PRIORITY int = 16*8 + 6
+)
+
+// Syslog sends every line as a message to a syslog socket.
+// log/syslog isn't available on every platform, and the format is simple enough to write ourselves.
+type Syslog struct {
+	network  string
+	address  string
+	tag      string
+	hostname string
+	conn     net.Conn
+}
+
+func DialSyslog(network string, address string, tag string) (*Syslog, error) {
+	if network == "" {
+		network = DEFAULT_SYSLOG_NETWORK
+	}
+	if address == "" {
+		address = DEFAULT_SYSLOG_ADDRESS
+	}
+	if tag == "" {
+		tag = DEFAULT_SYSLOG_TAG
+	}
+	hostname, _ := os.Hostname()
+
+	s := &Syslog{network: network, address: address, tag: tag, hostname: hostname}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Syslog) connect() error {
+	conn, err := net.DialTimeout(s.network, s.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// Write sends p as one message, reconnecting once if the socket went away (e.g. syslog restarted)
+func (s *Syslog) Write(p []byte) (int, error) {
+	msg := s.message(strings.TrimSuffix(string(p), "\n"))
+	if _, err := s.conn.Write(msg); err != nil {
+		s.conn.Close()
+		if err := s.connect(); err != nil {
+			return 0, err
+		}
+		if _, err := s.conn.Write(msg); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (s *Syslog) Close() error {
+	return s.conn.Close()
+}
+
+func (s *Syslog) message(line string) []byte {
+	timestamp := time.Now().Format(time.Stamp)
+	var msg string
+	if strings.HasPrefix(s.network, "unix") {
+		// The local daemon adds the hostname itself
+		msg = fmt.Sprintf("<%d>%s %s[%d]: %s", SYSLOG_PRIORITY, timestamp, s.tag, os.Getpid(), line)
+	} else {
+		msg = fmt.Sprintf("<%d>%s %s %s[%d]: %s", SYSLOG_PRIORITY, timestamp, s.hostname, s.tag, os.Getpid(), line)
+	}
+	// Stream sockets need a delimiter between the messages
+	if s.network == "tcp" || s.network == "unix" {
+		msg += "\n"
+	}
+	return []byte(msg)
+}
@@ -1,79 +1,519 @@
 package admin
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"sync"
+	"time"
 
+	"github.com/ibhiyassine/GoKnot/internal/config"
 	"github.com/ibhiyassine/GoKnot/internal/domain"
-	"github.com/ibhiyassine/GoKnot/internal/loadbalancer"
+	"github.com/ibhiyassine/GoKnot/internal/headers"
+	"github.com/ibhiyassine/GoKnot/internal/metrics"
+	"github.com/ibhiyassine/GoKnot/internal/ratelimit"
+	"github.com/ibhiyassine/GoKnot/internal/router"
 )
 
 type AdminServer struct {
-	loadBalancer loadbalancer.LoadBalancer
+	router    *router.Router
+	server    *http.Server
+	handler   http.Handler
+	serverMux sync.Mutex
+
+	// Reload re-reads and applies the config file, returning what changed and what needs a restart.
+	// POST /reload answers 501 when it is nil.
+	Reload func() (changes []string, pending []string, err error)
 }
 
-func NewAdminServer(lb loadbalancer.LoadBalancer) *AdminServer {
+func NewAdminServer(rt *router.Router) *AdminServer {
 	return &AdminServer{
-		loadBalancer: lb,
+		router: rt,
 	}
 }
 
 func (a *AdminServer) Start(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("[Admin] Server failed: %v", err)
+		return
+	}
+	a.Serve(ln)
+}
+
+// Serve answers the admin requests on the listener. When the server was already serving
+// on another one (e.g. the admin port changed on reload), that one is shut down gracefully.
+func (a *AdminServer) Serve(ln net.Listener) {
+	server := &http.Server{Handler: a.routes()}
+
+	a.serverMux.Lock()
+	previous := a.server
+	a.server = server
+	a.serverMux.Unlock()
+
+	if previous != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			previous.Shutdown(ctx)
+		}()
+	}
+
+	err := server.Serve(ln)
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("[Admin] Server failed: %v", err)
+	}
+}
+
+func (a *AdminServer) routes() http.Handler {
+	a.serverMux.Lock()
+	defer a.serverMux.Unlock()
+	if a.handler != nil {
+		return a.handler
+	}
+	mux := http.NewServeMux()
+
 	// GET /status
-	http.HandleFunc("/status", a.getStatus)
+	mux.HandleFunc("/status", a.getStatus)
+
+	// DELETE | POST | PATCH /backends
+	mux.HandleFunc("/backends", a.handleBackends)
+
+	// GET /pools
+	mux.HandleFunc("/pools", a.getPools)
+
+	// GET | DELETE | POST | PATCH /pools/{name}/backends
+	mux.HandleFunc("/pools/{name}/backends", a.handlePoolBackends)
+
+	// GET /metrics
+	mux.HandleFunc("/metrics", a.getMetrics)
+
+	// POST /reload
+	mux.HandleFunc("/reload", a.reload)
+
+	// GET /config
+	mux.HandleFunc("/config", a.getConfig)
+
+	// POST /headers/dry-run
+	mux.HandleFunc("/headers/dry-run", a.dryRunHeaders)
+
+	// GET /ratelimits
+	mux.HandleFunc("/ratelimits", a.getRateLimits)
 
-	// DELETE | POST /backends
-	http.HandleFunc("/backends", a.handleBackends)
+	// GET | PATCH | DELETE /ratelimits/{name}
+	mux.HandleFunc("/ratelimits/{name}", a.handleRateLimit)
+
+	a.handler = mux
+	return mux
+}
+
+// getConfig exports the running config, backends added, removed or changed through the API included
+func (a *AdminServer) getConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(a.router.Config()); err != nil {
+		http.Error(w, "Can't export the config", http.StatusInternalServerError)
+	}
+}
+
+func (a *AdminServer) reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Reload == nil {
+		http.Error(w, "Reloading is not available", http.StatusNotImplemented)
+		return
+	}
+
+	changes, pending, err := a.Reload()
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		// The running config was left untouched
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]any{
+			"reloaded": false,
+			"error":    err.Error(),
+		})
+		return
+	}
+	if changes == nil {
+		changes = []string{}
+	}
+	if pending == nil {
+		pending = []string{}
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"reloaded": true,
+		"changes":  changes,
+		"pending":  pending,
+	})
+}
 
-	http.ListenAndServe(addr, nil)
+// Shutdown stops the admin server, letting the requests being handled finish
+func (a *AdminServer) Shutdown(ctx context.Context) error {
+	a.serverMux.Lock()
+	defer a.serverMux.Unlock()
+	if a.server == nil {
+		return nil
+	}
+	return a.server.Shutdown(ctx)
 }
 
 func (a *AdminServer) getStatus(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		backends := a.loadBalancer.GetBackends()
+		// The status is the one of the default pool, the others are under /pools/{name}/backends
+		a.writeBackends(w, a.router.Default())
 
-		type backendJSON struct {
-			URL          string `json:"url"`
-			Alive        bool   `json:"alive"`
-			CurrentConns int64  `json:"current_connections"`
-		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+	return
 
-		cleanBackends := []backendJSON{}
-		for _, b := range backends {
-			cleanBackends = append(cleanBackends, backendJSON{
-				URL:          b.URL.String(),
-				Alive:        b.Alive,
-				CurrentConns: b.CurrentConns,
-			})
+}
+
+func (a *AdminServer) writeBackends(w http.ResponseWriter, pool *router.Pool) {
+	backends := pool.LB.GetBackends()
+
+	type backendJSON struct {
+		URL          string              `json:"url"`
+		Alive        bool                `json:"alive"`
+		CurrentConns int64               `json:"current_connections"`
+		Weight       int                 `json:"weight"`
+		Tags         []string            `json:"tags,omitempty"`
+		Draining     bool                `json:"draining"`
+		Ejected      bool                `json:"ejected"`
+		EjectedUntil *time.Time          `json:"ejected_until,omitempty"`
+		Ejections    int                 `json:"ejections"`
+		Breaker      domain.BreakerState `json:"breaker"`
+		Transitions  []domain.Transition `json:"breaker_transitions,omitempty"`
+	}
+
+	cleanBackends := []backendJSON{}
+	for _, b := range backends {
+		until, ejections := b.EjectionInfo()
+		state, transitions := b.Breaker.State()
+		entry := backendJSON{
+			URL:          b.URL.String(),
+			Alive:        b.Alive,
+			CurrentConns: b.CurrentConns,
+			Weight:       b.GetWeight(),
+			Tags:         b.GetTags(),
+			Draining:     b.IsDraining(),
+			Ejected:      b.IsEjected(),
+			Ejections:    ejections,
+			Breaker:      state,
+			Transitions:  transitions,
+		}
+		if entry.Ejected {
+			entry.EjectedUntil = &until
 		}
+		cleanBackends = append(cleanBackends, entry)
+	}
+
+	response := map[string]any{
+		"pool":           pool.Name,
+		"total_backends": len(backends),
+		"retries":        pool.Handler.Retries(),
+		"backends":       cleanBackends,
+	}
 
-		response := map[string]any{
-			"total_backends": len(backends),
-			"backends":       cleanBackends,
+	w.Header().Set("Content-type", "application/json")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		http.Error(w, "Can't retrieve backends status", http.StatusBadGateway)
+		return
+	}
+}
+
+func (a *AdminServer) getPools(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type poolJSON struct {
+		Name          string `json:"name"`
+		Strategy      string `json:"strategy"`
+		TotalBackends int    `json:"total_backends"`
+	}
+
+	pools := []poolJSON{}
+	for _, p := range a.router.Pools() {
+		pools = append(pools, poolJSON{
+			Name:          p.Name,
+			Strategy:      p.Strategy,
+			TotalBackends: len(p.LB.GetBackends()),
+		})
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]any{"pools": pools})
+	if err != nil {
+		http.Error(w, "Can't retrieve pools", http.StatusBadGateway)
+	}
+}
+
+// dryRunHeaders shows what the header rules would do to a request and to the response of its backend, nothing is sent
+func (a *AdminServer) dryRunHeaders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// {"method": "GET", "host": "example.com", "path": "/api", "client_ip": "203.0.113.7", "tls": false,
+	//  "headers": {...}, "backend": <optional_url>, "status": 200, "response_headers": {...}}
+	var body struct {
+		Method          string            `json:"method"`
+		Host            string            `json:"host"`
+		Path            string            `json:"path"`
+		ClientIP        string            `json:"client_ip"`
+		TLS             bool              `json:"tls"`
+		Headers         map[string]string `json:"headers"`
+		Backend         string            `json:"backend"`
+		Status          int               `json:"status"`
+		ResponseHeaders map[string]string `json:"response_headers"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if body.Method == "" {
+		body.Method = http.MethodGet
+	}
+	if body.Path == "" {
+		body.Path = "/"
+	}
+	if body.ClientIP == "" {
+		body.ClientIP = "127.0.0.1"
+	}
+	if body.Status == 0 {
+		body.Status = http.StatusOK
+	}
+
+	req, err := http.NewRequest(body.Method, body.Path, nil)
+	if err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Host = body.Host
+	req.RemoteAddr = net.JoinHostPort(body.ClientIP, "0")
+	for name, value := range body.Headers {
+		req.Header.Set(name, value)
+	}
+	if body.TLS {
+		req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256, ServerName: body.Host}
+	}
+
+	// The request gets an ID like a proxied one, the one given in headers if there is one
+	req = a.router.RequestIDs().Ensure(httptest.NewRecorder(), req)
+
+	pool, rules := a.router.HeaderRules(req)
+	backend := body.Backend
+	if backend == "" {
+		if backends := pool.LB.GetBackends(); len(backends) > 0 {
+			backend = backends[0].URL.String()
 		}
+	}
 
+	vars := headers.NewVars(req, backend)
+	rules.ApplyRequest(req, vars)
+	response := http.Header{}
+	for name, value := range body.ResponseHeaders {
+		response.Set(name, value)
+	}
+	vars.Status = body.Status
+	rules.ApplyResponse(response, vars)
+
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"pool":    pool.Name,
+		"backend": backend,
+		"request": map[string]any{
+			"host":    req.Host,
+			"headers": req.Header,
+		},
+		"response": map[string]any{
+			"headers": response,
+		},
+	})
+}
+
+type rateLimitJSON struct {
+	Name    string             `json:"name"`
+	Key     string             `json:"key"`
+	Rate    float64            `json:"rate"`
+	Burst   int                `json:"burst"`
+	Clients int                `json:"clients"`
+	Buckets []ratelimit.Bucket `json:"buckets,omitempty"`
+}
+
+func describeLimiter(l *ratelimit.Limiter, withBuckets bool) rateLimitJSON {
+	rate, burst := l.Limits()
+	buckets := l.Buckets()
+	entry := rateLimitJSON{Name: l.Name, Key: l.Key, Rate: rate, Burst: burst, Clients: len(buckets)}
+	if withBuckets {
+		entry.Buckets = buckets
+	}
+	return entry
+}
+
+// getRateLimits lists the limiters of the pools and of the routes
+func (a *AdminServer) getRateLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limiters := []rateLimitJSON{}
+	for _, l := range a.router.Limiters() {
+		limiters = append(limiters, describeLimiter(l, false))
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]any{"rate_limits": limiters})
+	if err != nil {
+		http.Error(w, "Can't retrieve rate limits", http.StatusBadGateway)
+	}
+}
+
+// handleRateLimit shows the clients of a limiter (GET), changes its limits (PATCH)
+// or resets the buckets, of every client or only of ?key=<client> (DELETE).
+// Changes last until the limiter settings are changed in the config, they aren't saved in the state file.
+func (a *AdminServer) handleRateLimit(w http.ResponseWriter, r *http.Request) {
+	limiter := a.router.Limiter(r.PathValue("name"))
+	if limiter == nil {
+		http.Error(w, "Rate limit not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
 		w.Header().Set("Content-type", "application/json")
-		err := json.NewEncoder(w).Encode(response)
-		if err != nil {
-			http.Error(w, "Can't retrieve backends status", http.StatusBadGateway)
+		if err := json.NewEncoder(w).Encode(describeLimiter(limiter, true)); err != nil {
+			http.Error(w, "Can't retrieve rate limit", http.StatusBadGateway)
+		}
+
+	case http.MethodPatch:
+		// {"rate": <optional_rate>, "burst": <optional_burst>}
+		var body struct {
+			Rate  float64 `json:"rate"`
+			Burst int     `json:"burst"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if body.Rate < 0 || body.Burst < 0 {
+			http.Error(w, "Rate and burst can't be negative", http.StatusBadRequest)
+			return
+		}
+		if body.Rate == 0 && body.Burst == 0 {
+			http.Error(w, "Nothing to change, give a rate or a burst", http.StatusBadRequest)
 			return
 		}
+		rate, burst := limiter.Limits()
+		if body.Rate > 0 {
+			rate = body.Rate
+		}
+		if body.Burst > 0 {
+			burst = body.Burst
+		}
+		if err := limiter.SetLimits(rate, burst); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("[Admin] Changed rate limit %s to %g/s, burst %d", limiter.Name, rate, burst)
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodDelete:
+		key := r.URL.Query().Get("key")
+		limiter.Reset(key)
+		if key == "" {
+			log.Printf("[Admin] Reset every client of rate limit %s", limiter.Name)
+		} else {
+			log.Printf("[Admin] Reset client %s of rate limit %s", key, limiter.Name)
+		}
+		w.WriteHeader(http.StatusOK)
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
-	return
+}
+
+// getMetrics exposes the metrics in the Prometheus text format
+func (a *AdminServer) getMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.Default.Write(w)
+
+	// The state of the backends is read now rather than tracked on every request
+	var up, conns, ejected, breaker []metrics.Gauge
+	for _, pool := range a.router.Pools() {
+		for _, b := range pool.LB.GetBackends() {
+			labels := map[string]string{"pool": pool.Name, "backend": b.URL.String()}
+			state, _ := b.Breaker.State()
+			up = append(up, metrics.Gauge{Labels: labels, Value: boolToFloat(b.IsAlive())})
+			conns = append(conns, metrics.Gauge{Labels: labels, Value: float64(b.GetConns())})
+			ejected = append(ejected, metrics.Gauge{Labels: labels, Value: boolToFloat(b.IsEjected())})
+			breaker = append(breaker, metrics.Gauge{Labels: labels, Value: float64(state)})
+		}
+	}
+	metrics.WriteGauges(w, "goknot_backend_up", "1 when the health checks consider the backend alive.", up)
+	metrics.WriteGauges(w, "goknot_backend_active_connections", "Requests currently sent to the backend.", conns)
+	metrics.WriteGauges(w, "goknot_backend_ejected", "1 when the backend is ejected by the outlier detection.", ejected)
+	metrics.WriteGauges(w, "goknot_backend_breaker_state", "Circuit breaker state: 0 closed, 1 open, 2 half-open.", breaker)
+}
 
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 func (a *AdminServer) handleBackends(w http.ResponseWriter, r *http.Request) {
+	a.manageBackends(w, r, config.DEFAULT_POOL)
+}
+
+func (a *AdminServer) handlePoolBackends(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if r.Method == http.MethodGet {
+		pool := a.router.Pool(name)
+		if pool == nil {
+			http.Error(w, "Pool not found", http.StatusNotFound)
+			return
+		}
+		a.writeBackends(w, pool)
+		return
+	}
+	a.manageBackends(w, r, name)
+}
+
+func (a *AdminServer) manageBackends(w http.ResponseWriter, r *http.Request, name string) {
 	// The body of the request will be as follow
-	// {"url" : "<url_of_the_backend>"}
+	// {"url" : "<url_of_the_backend>", "weight": <optional_weight>, "tags": [<optional_tags>], "draining": <optional_bool>}
 	var body struct {
-		URL string `json:"url"`
+		URL      string   `json:"url"`
+		Weight   int      `json:"weight"`
+		Tags     []string `json:"tags"`
+		Draining *bool    `json:"draining"` // only for PATCH
 	}
 	err := json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
@@ -87,31 +527,91 @@ func (a *AdminServer) handleBackends(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	switch r.Method {
-	case http.MethodPost:
-		a.handleBackendsPost(w, parsedURL)
+	// The pool is looked up again under the router lock, a reload may have replaced it
+	var changed bool
+	found := a.router.Change(name, func(pool *router.Pool) {
+		switch r.Method {
+		case http.MethodPost:
+			changed = a.handleBackendsPost(w, pool, parsedURL, body.Weight, body.Tags)
 
-	case http.MethodDelete:
-		a.handleBackendsDelete(w, parsedURL)
+		case http.MethodDelete:
+			changed = a.handleBackendsDelete(w, pool, parsedURL)
 
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		case http.MethodPatch:
+			changed = a.handleBackendsPatch(w, pool, parsedURL, body.Weight, body.Tags, body.Draining)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	if !found {
+		http.Error(w, "Pool not found", http.StatusNotFound)
+		return
 	}
 
+	// The change has to survive a restart
+	if changed {
+		if err := a.router.SaveState(); err != nil {
+			log.Printf("[Admin] Failed to save the state file: %v", err)
+		}
+	}
 }
 
-func (a *AdminServer) handleBackendsPost(w http.ResponseWriter, uri *url.URL) {
-	b := &domain.Backend{
-		URL:   uri,
-		Alive: true, // Default to true, HealthCheck will correct it if false
+func (a *AdminServer) handleBackendsPost(w http.ResponseWriter, pool *router.Pool, uri *url.URL, weight int, tags []string) bool {
+	if weight < 0 {
+		http.Error(w, "Weight can't be negative", http.StatusBadRequest)
+		return false
 	}
-	a.loadBalancer.AddBackend(b)
-	log.Printf("[Admin] Added backend: %s", uri)
+	if _, err := pool.LB.GetBackend(uri); err == nil {
+		http.Error(w, "Backend already in the pool", http.StatusConflict)
+		return false
+	}
+	// Default to alive, HealthCheck will correct it if false
+	b := pool.AddBackend(uri, weight, tags)
+	log.Printf("[Admin] Added backend to pool %s: %s (weight %d)", pool.Name, uri, b.GetWeight())
 	w.WriteHeader(http.StatusCreated)
+	return true
+}
+
+func (a *AdminServer) handleBackendsDelete(w http.ResponseWriter, pool *router.Pool, uri *url.URL) bool {
+	pool.RemoveBackend(uri)
+	log.Printf("[Admin] Removed backend from pool %s: %s", pool.Name, uri)
+	w.WriteHeader(http.StatusOK)
+	return true
 }
 
-func (a *AdminServer) handleBackendsDelete(w http.ResponseWriter, uri *url.URL) {
-	a.loadBalancer.RemoveBackend(uri)
-	log.Printf("[Admin] Removed backend: %s", uri)
+func (a *AdminServer) handleBackendsPatch(w http.ResponseWriter, pool *router.Pool, uri *url.URL, weight int, tags []string, draining *bool) bool {
+	if weight == 0 && tags == nil && draining == nil {
+		http.Error(w, "Nothing to change, give a weight, tags or a draining state", http.StatusBadRequest)
+		return false
+	}
+	if weight < 0 {
+		http.Error(w, "Weight must be at least 1", http.StatusBadRequest)
+		return false
+	}
+	b, err := pool.LB.GetBackend(uri)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return false
+	}
+
+	// The backend stays in the pool, in-flight requests aren't touched
+	if weight > 0 {
+		b.SetWeight(weight)
+		log.Printf("[Admin] Changed weight of backend %s in pool %s to %d", uri, pool.Name, weight)
+	}
+	if draining != nil {
+		b.SetDraining(*draining)
+		if *draining {
+			log.Printf("[Admin] Draining backend %s in pool %s (%d connections left)", uri, pool.Name, b.GetConns())
+		} else {
+			log.Printf("[Admin] Backend %s in pool %s is back in rotation", uri, pool.Name)
+		}
+	}
+	if tags != nil {
+		b.SetTags(tags)
+		log.Printf("[Admin] Changed tags of backend %s in pool %s to %v", uri, pool.Name, tags)
+	}
 	w.WriteHeader(http.StatusOK)
+	return true
 }
@@ -2,15 +2,412 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"time"
 )
 
+// Name of the pool built from the top level settings, it receives the requests no route matched
+const DEFAULT_POOL string = "default"
+
+const DEFAULT_STRATEGY string = "round_robin"
+
+// How long in-flight requests are waited for when shutting down
+const DEFAULT_SHUTDOWN_TIMEOUT time.Duration = 30 * time.Second
+
+// Shortest outlier detection window, it is cut in buckets that must last more than a few nanoseconds
+const MIN_OUTLIER_WINDOW time.Duration = time.Second
+
 type ProxyConfig struct {
-	Port            int           `json:"port"`
-	AdminPort       int           `json:"admin"`
-	Strategy        string        `json:"strategy"`
-	HealthCheckFreq time.Duration `json:"health_check_frequency"`
+	Port             int                 `json:"port"`
+	AdminPort        int                 `json:"admin"`
+	ShutdownTimeout  time.Duration       `json:"shutdown_timeout"`
+	Headless         bool                `json:"headless"` // run without the TUI
+	Strategy         string              `json:"strategy"`
+	HashKey          string              `json:"hash_key"` // only used by consistent_hash: ip, path, header:<name> or cookie:<name>
+	HealthCheckFreq  time.Duration       `json:"health_check_frequency"`
+	HealthCheck      HealthCheckConfig   `json:"health_check"`
+	UpstreamTLS      UpstreamTLSConfig   `json:"upstream_tls"`
+	Transport        TransportConfig     `json:"transport"`
+	Backends         []BackendConfig     `json:"backends"`
+	StickySessions   StickyConfig        `json:"sticky_sessions"`
+	Retry            RetryConfig         `json:"retry"`
+	OutlierDetection OutlierConfig       `json:"outlier_detection"`
+	CircuitBreaker   BreakerConfig       `json:"circuit_breaker"`
+	Pools            []PoolConfig        `json:"pools"`
+	Routes           []RouteConfig       `json:"routes"`
+	AccessLog        AccessLogConfig     `json:"access_log"`
+	StateFile        string              `json:"state_file"` // keeps the changes made through the admin API across restarts
+	TLS              TLSConfig           `json:"tls"`
+	RateLimit        RateLimitConfig     `json:"rate_limit"` // of the default pool
+	RequestID        RequestIDConfig     `json:"request_id"`
+	CORS             *CORSConfig         `json:"cors,omitempty"` // of the default pool
+	HeaderRules      HeaderRulesConfig   `json:"header_rules"`   // same
+	Forwarding       ForwardingConfig    `json:"forwarding"`
+	ProxyProtocol    ProxyProtocolConfig `json:"proxy_protocol"` // on the proxy listeners
+}
+
+// TLSConfig adds an HTTPS listener, disabled when the port is 0
+type TLSConfig struct {
+	Port           int                 `json:"port"`
+	Certificates   []CertificateConfig `json:"certificates"`  // the one matching the SNI is served, the first one otherwise
+	MinVersion     string              `json:"min_version"`   // 1.0, 1.1, 1.2 (default) or 1.3
+	CipherSuites   []string            `json:"cipher_suites"` // names from crypto/tls, only used up to TLS 1.2
+	RedirectHTTP   bool                `json:"redirect_http"` // the plain port only redirects to HTTPS
+	ClientCA       string              `json:"client_ca"`     // PEM bundle, enables client certificate verification (mTLS)
+	ClientAuth     string              `json:"client_auth"`   // require (default) or optional
+	IdentityHeader string              `json:"identity_header"`
+}
+
+type CertificateConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// AccessLogConfig writes one record per proxied request
+type AccessLogConfig struct {
+	Enabled       bool     `json:"enabled"`
+	Format        string   `json:"format"`         // json (default), common, combined, or a template like "{{.Method}} {{.Path}} {{.Status}}"
+	Output        string   `json:"output"`         // file (default), stdout or syslog
+	Path          string   `json:"path"`           // of the file, logs/access.log by default
+	MaxSize       int      `json:"max_size"`       // in megabytes before the file is rotated, 0 means no limit
+	RotateEvery   Duration `json:"rotate_every"`   // rotate the file after this long, whatever its size
+	MaxBackups    int      `json:"max_backups"`    // rotated files kept, 0 keeps all of them
+	Compress      bool     `json:"compress"`       // gzip the rotated files
+	SyslogNetwork string   `json:"syslog_network"` // unixgram (default), unix, udp or tcp
+	SyslogAddress string   `json:"syslog_address"` // /dev/log by default
+	SyslogTag     string   `json:"syslog_tag"`
+}
+
+// StickyConfig enables cookie based session affinity
+type StickyConfig struct {
+	Enabled    bool   `json:"enabled"`
+	CookieName string `json:"cookie_name"`
+	Secret     string `json:"secret"` // used to sign the cookie
+}
+
+// RetryConfig sends failed requests again to another backend, disabled when max_attempts is below 2
+type RetryConfig struct {
+	MaxAttempts   int      `json:"max_attempts"` // first try included
+	PerTryTimeout Duration `json:"per_try_timeout"`
+	Budget        Duration `json:"budget"`        // overall time for all the attempts
+	RetryOn       []int    `json:"retry_on"`      // status codes, e.g. [502, 503, 504]
+	MaxBodySize   int64    `json:"max_body_size"` // in bytes, bigger bodies are never retried
+}
+
+// HealthCheckConfig describes how backends are probed, fields left empty keep the value they inherit
+// (from the global settings for a pool, from the pool for a backend)
+type HealthCheckConfig struct {
+	Type           string            `json:"type"` // tcp (default) or http
+	Path           string            `json:"path"`
+	Method         string            `json:"method"`
+	Headers        map[string]string `json:"headers"`
+	ExpectedStatus []string          `json:"expected_status"` // "200" or "200-399"
+	BodyRegex      string            `json:"body_regex"`
+	Timeout        Duration          `json:"timeout"`
+	Rise           int               `json:"rise"` // consecutive successes before marking a backend alive
+	Fall           int               `json:"fall"` // consecutive failures before marking a backend dead
+}
+
+// Merge returns the settings with the non empty fields of the override applied on top
+func (h HealthCheckConfig) Merge(override *HealthCheckConfig) HealthCheckConfig {
+	if override == nil {
+		return h
+	}
+	if override.Type != "" {
+		h.Type = override.Type
+	}
+	if override.Path != "" {
+		h.Path = override.Path
+	}
+	if override.Method != "" {
+		h.Method = override.Method
+	}
+	if override.Headers != nil {
+		h.Headers = override.Headers
+	}
+	if override.ExpectedStatus != nil {
+		h.ExpectedStatus = override.ExpectedStatus
+	}
+	if override.BodyRegex != "" {
+		h.BodyRegex = override.BodyRegex
+	}
+	if override.Timeout > 0 {
+		h.Timeout = override.Timeout
+	}
+	if override.Rise > 0 {
+		h.Rise = override.Rise
+	}
+	if override.Fall > 0 {
+		h.Fall = override.Fall
+	}
+	return h
+}
+
+// OutlierConfig ejects backends failing on live traffic, disabled when no threshold is set
+type OutlierConfig struct {
+	Consecutive5xx           int      `json:"consecutive_5xx"`
+	ConsecutiveGatewayErrors int      `json:"consecutive_gateway_errors"`
+	ErrorRate                int      `json:"error_rate"` // percentage of 5xx over the window
+	MinRequests              int      `json:"min_requests"`
+	Window                   Duration `json:"window"`
+	BaseEjectionTime         Duration `json:"base_ejection_time"`
+	MaxEjectionTime          Duration `json:"max_ejection_time"`
+	MaxEjectionPercent       int      `json:"max_ejection_percent"`
+}
+
+func (o OutlierConfig) Enabled() bool {
+	return o.Consecutive5xx > 0 || o.ConsecutiveGatewayErrors > 0 || o.ErrorRate > 0
+}
+
+func (o OutlierConfig) validate(pool string) error {
+	if o.Window > 0 && time.Duration(o.Window) < MIN_OUTLIER_WINDOW {
+		return fmt.Errorf("Pool %s: outlier detection window must be at least %v", pool, MIN_OUTLIER_WINDOW)
+	}
+	return nil
+}
+
+// BreakerConfig adds a circuit breaker to every backend of the pool,
+// disabled when neither the failure ratio nor the slow threshold is set
+type BreakerConfig struct {
+	FailureRatio     float64  `json:"failure_ratio"`  // between 0 and 1
+	SlowThreshold    Duration `json:"slow_threshold"` // slower requests count as failures
+	MinRequests      int      `json:"min_requests"`
+	Window           Duration `json:"window"`
+	OpenTimeout      Duration `json:"open_timeout"`
+	HalfOpenRequests int      `json:"half_open_requests"`
+}
+
+func (b BreakerConfig) Enabled() bool {
+	return b.FailureRatio > 0 || b.SlowThreshold > 0
+}
+
+// BackendConfig is a backend declared directly in the config file
+type BackendConfig struct {
+	URL         string             `json:"url"`
+	Weight      int                `json:"weight"`
+	Tags        []string           `json:"tags,omitempty"`
+	Draining    bool               `json:"draining,omitempty"`     // starts without receiving new requests
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"` // overrides the one of the pool
+	TLS         *UpstreamTLSConfig `json:"tls,omitempty"`          // overrides the upstream TLS settings of the pool
+}
+
+// TransportConfig tunes the connection pool kept to each backend, fields left empty keep the value they inherit
+type TransportConfig struct {
+	MaxIdleConns          int      `json:"max_idle_conns"`     // kept open for reuse, 100 by default
+	MaxConnsPerHost       int      `json:"max_conns_per_host"` // 0 means no limit
+	IdleConnTimeout       Duration `json:"idle_conn_timeout"`
+	DialTimeout           Duration `json:"dial_timeout"`
+	TLSHandshakeTimeout   Duration `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout Duration `json:"response_header_timeout"` // 0 means no limit
+	DisableHTTP2          bool     `json:"disable_http2"`           // HTTP/2 is used with https:// backends supporting it
+	ProxyProtocol         int      `json:"proxy_protocol"`          // 1 or 2 sends a PROXY protocol header on each connection, 0 doesn't
+}
+
+// Merge returns the settings with the non empty fields of the override applied on top
+func (t TransportConfig) Merge(override *TransportConfig) TransportConfig {
+	if override == nil {
+		return t
+	}
+	if override.MaxIdleConns > 0 {
+		t.MaxIdleConns = override.MaxIdleConns
+	}
+	if override.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = override.MaxConnsPerHost
+	}
+	if override.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = override.IdleConnTimeout
+	}
+	if override.DialTimeout > 0 {
+		t.DialTimeout = override.DialTimeout
+	}
+	if override.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = override.TLSHandshakeTimeout
+	}
+	if override.ResponseHeaderTimeout > 0 {
+		t.ResponseHeaderTimeout = override.ResponseHeaderTimeout
+	}
+	if override.DisableHTTP2 {
+		t.DisableHTTP2 = true
+	}
+	if override.ProxyProtocol > 0 {
+		t.ProxyProtocol = override.ProxyProtocol
+	}
+	return t
+}
+
+func (t TransportConfig) validate(pool string) error {
+	if t.ProxyProtocol != 0 && t.ProxyProtocol != 1 && t.ProxyProtocol != 2 {
+		return fmt.Errorf("Pool %s: proxy protocol version %d isn't 1 or 2", pool, t.ProxyProtocol)
+	}
+	return nil
+}
+
+// UpstreamTLSConfig is how https:// backends are reached, fields left empty keep the value they inherit
+// (from the global settings for a pool, from the pool for a backend)
+type UpstreamTLSConfig struct {
+	CA                 string `json:"ca"`                   // PEM bundle, the system roots when empty
+	CertFile           string `json:"cert_file"`            // client certificate, for backends requiring mTLS
+	KeyFile            string `json:"key_file"`             // its key
+	ServerName         string `json:"server_name"`          // sent as SNI and verified, the host of the backend URL by default
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // lab use only, anyone can impersonate the backend
+}
+
+// Merge returns the settings with the non empty fields of the override applied on top
+func (u UpstreamTLSConfig) Merge(override *UpstreamTLSConfig) UpstreamTLSConfig {
+	if override == nil {
+		return u
+	}
+	if override.CA != "" {
+		u.CA = override.CA
+	}
+	if override.CertFile != "" {
+		u.CertFile, u.KeyFile = override.CertFile, override.KeyFile
+	}
+	if override.ServerName != "" {
+		u.ServerName = override.ServerName
+	}
+	if override.InsecureSkipVerify {
+		u.InsecureSkipVerify = true
+	}
+	return u
+}
+
+// ForwardingConfig is which proxies in front of GoKnot are believed about the client they forward
+type ForwardingConfig struct {
+	TrustedProxies []string `json:"trusted_proxies"` // IPs or CIDRs
+	Forwarded      bool     `json:"forwarded"`       // also send the RFC 7239 Forwarded header
+}
+
+// ProxyProtocolConfig reads the PROXY protocol header (v1 or v2) that load balancers in front of GoKnot
+// put at the start of the connections, the address it gives replaces the one of the connection
+type ProxyProtocolConfig struct {
+	Enabled        bool     `json:"enabled"`
+	TrustedSources []string `json:"trusted_sources"` // IPs or CIDRs that must send the header, all of them when empty
+	HeaderTimeout  Duration `json:"header_timeout"`  // to receive the header, 5s by default
+}
+
+// HeaderRulesConfig rewrites the headers sent to the backends (request) and back to the clients (response)
+type HeaderRulesConfig struct {
+	Request  []HeaderRuleConfig `json:"request,omitempty"`
+	Response []HeaderRuleConfig `json:"response,omitempty"`
+}
+
+// HeaderRuleConfig is one change, rules are applied in order
+type HeaderRuleConfig struct {
+	Action string `json:"action"`          // set, add, remove or rename
+	Name   string `json:"name"`            // a trailing * removes every header starting with the rest
+	Value  string `json:"value,omitempty"` // for set and add, a template like "{{.ClientIP}}" when it contains "{{"
+	To     string `json:"to,omitempty"`    // new name, for rename
+}
+
+// CORSConfig is the CORS policy applied by the proxy on behalf of the backends
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"` // exact, "*", with a wildcard like "https://*.example.com", or "regex:<expression>"
+	AllowedMethods   []string `json:"allowed_methods"` // GET, HEAD and POST by default
+	AllowedHeaders   []string `json:"allowed_headers"` // "*" allows any
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           Duration `json:"max_age"`      // how long browsers can cache a preflight
+	PassThrough      bool     `json:"pass_through"` // leaves CORS to the backends, preflights included
+}
+
+// RequestIDConfig is how requests are identified across the logs of the proxy and of the backends.
+// An ID coming with the request is kept, the others get a new one.
+type RequestIDConfig struct {
+	Header string `json:"header"` // X-Request-ID by default
+	Format string `json:"format"` // uuid (v4, default) or ulid
+}
+
+// RateLimitConfig gives each client a token bucket of Burst requests refilled at Rate per second, disabled when Rate is 0
+type RateLimitConfig struct {
+	Rate  float64 `json:"rate"`  // requests per second
+	Burst int     `json:"burst"` // the rate rounded up by default
+	Key   string  `json:"key"`   // what a client is: ip (default), header:<name> like header:X-API-Key, or route for a single bucket
+}
+
+func (r RateLimitConfig) Enabled() bool {
+	return r.Rate > 0
+}
+
+// PoolConfig is a named group of backends with its own strategy and health checking
+type PoolConfig struct {
+	Name             string             `json:"name"`
+	Strategy         string             `json:"strategy"`
+	HashKey          string             `json:"hash_key"`
+	HealthCheckFreq  Duration           `json:"health_check_frequency"`
+	HealthCheck      *HealthCheckConfig `json:"health_check"` // merged over the global one
+	UpstreamTLS      *UpstreamTLSConfig `json:"upstream_tls"` // merged over the global one
+	Transport        *TransportConfig   `json:"transport"`    // merged over the global one
+	Backends         []BackendConfig    `json:"backends"`
+	StickySessions   StickyConfig       `json:"sticky_sessions"`
+	Retry            RetryConfig        `json:"retry"`
+	OutlierDetection OutlierConfig      `json:"outlier_detection"`
+	CircuitBreaker   BreakerConfig      `json:"circuit_breaker"`
+	RateLimit        RateLimitConfig    `json:"rate_limit"`
+	CORS             *CORSConfig        `json:"cors,omitempty"` // left to the backends when nil
+	HeaderRules      HeaderRulesConfig  `json:"header_rules"`
+}
+
+// RouteConfig sends the requests matching every one of its conditions to a pool.
+// Routes are tried in order, the first one matching wins.
+type RouteConfig struct {
+	Host        string             `json:"host"` // exact, or "*.example.com" for any subdomain
+	PathPrefix  string             `json:"path_prefix"`
+	PathRegex   string             `json:"path_regex"`
+	Methods     []string           `json:"methods"`
+	Headers     map[string]string  `json:"headers"` // an empty value only requires the header to be present
+	Pool        string             `json:"pool"`
+	RateLimit   *RateLimitConfig   `json:"rate_limit,omitempty"`   // replaces the one of the pool for the requests of this route
+	CORS        *CORSConfig        `json:"cors,omitempty"`         // same
+	HeaderRules *HeaderRulesConfig `json:"header_rules,omitempty"` // applied after the ones of the pool
+	Rewrite     *RewriteConfig     `json:"rewrite,omitempty"`
+	Redirect    *RedirectConfig    `json:"redirect,omitempty"` // answered by the proxy, pool can then be left empty
+}
+
+// RewriteConfig changes the path sent to the backend, in this order: strip, regex replace, add
+type RewriteConfig struct {
+	StripPrefix string `json:"strip_prefix"`
+	Regex       string `json:"regex"`
+	Replacement string `json:"replacement"` // can use the groups of the regex, like $1 or ${name}
+	AddPrefix   string `json:"add_prefix"`
+}
+
+// RedirectConfig answers the requests of a route with a redirect to the rewritten path, query included
+type RedirectConfig struct {
+	Code int    `json:"code"` // 301, 302 (default), 303, 307 or 308
+	URL  string `json:"url"`  // scheme and host put in front of the path, like "https://new.example.com", the same host when empty
+}
+
+// Duration is a time.Duration written as a string in the config ("10s", "1m")
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// MarshalJSON writes the durations the way LoadConfig reads them, so an exported config can be loaded again
+func (cfg ProxyConfig) MarshalJSON() ([]byte, error) {
+	type plain ProxyConfig // without the method, or it would call itself
+	return json.Marshal(struct {
+		plain
+		ShutdownTimeout Duration `json:"shutdown_timeout"`
+		HealthCheckFreq Duration `json:"health_check_frequency"`
+	}{plain(cfg), Duration(cfg.ShutdownTimeout), Duration(cfg.HealthCheckFreq)})
 }
 
 func LoadConfig(filename string) (*ProxyConfig, error) {
@@ -27,10 +424,32 @@ func LoadConfig(filename string) (*ProxyConfig, error) {
 	 */
 	//FIXME: If there is a better way I would like to know about it.
 	var temp struct {
-		Port            int    `json:"port"`
-		AdminPort       int    `json:"admin"`
-		Strategy        string `json:"strategy"`
-		HealthCheckFreq string `json:"health_check_frequency"` // as you can see we are getting a string
+		Port             int                 `json:"port"`
+		AdminPort        int                 `json:"admin"`
+		ShutdownTimeout  Duration            `json:"shutdown_timeout"`
+		Headless         bool                `json:"headless"`
+		Strategy         string              `json:"strategy"`
+		HashKey          string              `json:"hash_key"`
+		HealthCheckFreq  string              `json:"health_check_frequency"` // as you can see we are getting a string
+		HealthCheck      HealthCheckConfig   `json:"health_check"`
+		UpstreamTLS      UpstreamTLSConfig   `json:"upstream_tls"`
+		Transport        TransportConfig     `json:"transport"`
+		Backends         []BackendConfig     `json:"backends"`
+		StickySessions   StickyConfig        `json:"sticky_sessions"`
+		Retry            RetryConfig         `json:"retry"`
+		OutlierDetection OutlierConfig       `json:"outlier_detection"`
+		CircuitBreaker   BreakerConfig       `json:"circuit_breaker"`
+		Pools            []PoolConfig        `json:"pools"`
+		Routes           []RouteConfig       `json:"routes"`
+		AccessLog        AccessLogConfig     `json:"access_log"`
+		StateFile        string              `json:"state_file"`
+		TLS              TLSConfig           `json:"tls"`
+		RateLimit        RateLimitConfig     `json:"rate_limit"`
+		RequestID        RequestIDConfig     `json:"request_id"`
+		CORS             *CORSConfig         `json:"cors"`
+		HeaderRules      HeaderRulesConfig   `json:"header_rules"`
+		Forwarding       ForwardingConfig    `json:"forwarding"`
+		ProxyProtocol    ProxyProtocolConfig `json:"proxy_protocol"`
 	}
 
 	decoder := json.NewDecoder(file)
@@ -44,11 +463,121 @@ func LoadConfig(filename string) (*ProxyConfig, error) {
 		return nil, err
 	}
 
-	return &ProxyConfig{
-		Port:            temp.Port,
-		AdminPort:       temp.AdminPort,
-		Strategy:        temp.Strategy,
-		HealthCheckFreq: duration,
-	}, nil
+	cfg := &ProxyConfig{
+		Port:             temp.Port,
+		AdminPort:        temp.AdminPort,
+		ShutdownTimeout:  time.Duration(temp.ShutdownTimeout),
+		Headless:         temp.Headless,
+		Strategy:         temp.Strategy,
+		HashKey:          temp.HashKey,
+		HealthCheckFreq:  duration,
+		HealthCheck:      temp.HealthCheck,
+		UpstreamTLS:      temp.UpstreamTLS,
+		Transport:        temp.Transport,
+		Backends:         temp.Backends,
+		StickySessions:   temp.StickySessions,
+		Retry:            temp.Retry,
+		OutlierDetection: temp.OutlierDetection,
+		CircuitBreaker:   temp.CircuitBreaker,
+		Pools:            temp.Pools,
+		Routes:           temp.Routes,
+		AccessLog:        temp.AccessLog,
+		StateFile:        temp.StateFile,
+		TLS:              temp.TLS,
+		RateLimit:        temp.RateLimit,
+		RequestID:        temp.RequestID,
+		CORS:             temp.CORS,
+		HeaderRules:      temp.HeaderRules,
+		Forwarding:       temp.Forwarding,
+		ProxyProtocol:    temp.ProxyProtocol,
+	}
 
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = DEFAULT_SHUTDOWN_TIMEOUT
+	}
+
+	if err := cfg.validatePools(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+
+}
+
+// DefaultPool returns the pool described by the top level settings
+func (cfg *ProxyConfig) DefaultPool() PoolConfig {
+	return PoolConfig{
+		Name:             DEFAULT_POOL,
+		Strategy:         cfg.Strategy,
+		HashKey:          cfg.HashKey,
+		HealthCheckFreq:  Duration(cfg.HealthCheckFreq),
+		HealthCheck:      &cfg.HealthCheck,
+		UpstreamTLS:      &cfg.UpstreamTLS,
+		Transport:        &cfg.Transport,
+		Backends:         cfg.Backends,
+		StickySessions:   cfg.StickySessions,
+		Retry:            cfg.Retry,
+		OutlierDetection: cfg.OutlierDetection,
+		CircuitBreaker:   cfg.CircuitBreaker,
+		RateLimit:        cfg.RateLimit,
+		CORS:             cfg.CORS,
+		HeaderRules:      cfg.HeaderRules,
+	}
+}
+
+// AllPools returns the default pool followed by the named ones
+func (cfg *ProxyConfig) AllPools() []PoolConfig {
+	return append([]PoolConfig{cfg.DefaultPool()}, cfg.Pools...)
+}
+
+// validatePools fills the pools settings that were left empty with the top level ones
+// and makes sure every route points to an existing pool
+func (cfg *ProxyConfig) validatePools() error {
+	if err := cfg.Transport.validate(DEFAULT_POOL); err != nil {
+		return err
+	}
+	if err := cfg.OutlierDetection.validate(DEFAULT_POOL); err != nil {
+		return err
+	}
+	names := map[string]bool{DEFAULT_POOL: true}
+	for i := range cfg.Pools {
+		p := &cfg.Pools[i]
+		if p.Name == "" {
+			return errors.New("Every pool needs a name")
+		}
+		if names[p.Name] {
+			return fmt.Errorf("Pool %s is declared twice", p.Name)
+		}
+		names[p.Name] = true
+
+		if p.Strategy == "" {
+			p.Strategy = DEFAULT_STRATEGY
+		}
+		if p.HealthCheckFreq <= 0 {
+			p.HealthCheckFreq = Duration(cfg.HealthCheckFreq)
+		}
+		merged := cfg.HealthCheck.Merge(p.HealthCheck)
+		p.HealthCheck = &merged
+		upstream := cfg.UpstreamTLS.Merge(p.UpstreamTLS)
+		p.UpstreamTLS = &upstream
+		transport := cfg.Transport.Merge(p.Transport)
+		p.Transport = &transport
+		if err := transport.validate(p.Name); err != nil {
+			return err
+		}
+		if err := p.OutlierDetection.validate(p.Name); err != nil {
+			return err
+		}
+	}
+
+	for i := range cfg.Routes {
+		route := &cfg.Routes[i]
+		if route.Pool == "" && route.Redirect != nil {
+			// Nothing is proxied, the pool is only there for the rate limit and the CORS policy
+			route.Pool = DEFAULT_POOL
+		}
+		if !names[route.Pool] {
+			return fmt.Errorf("Route points to unknown pool %q", route.Pool)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Pending lists the changes that can't be applied by a reload, they only take effect on restart
+func Pending(old *ProxyConfig, next *ProxyConfig) []string {
+	var pending []string
+	if old.Headless != next.Headless {
+		pending = append(pending, fmt.Sprintf("headless: %v -> %v (needs a restart)", old.Headless, next.Headless))
+	}
+	if !reflect.DeepEqual(old.TLS, next.TLS) {
+		pending = append(pending, "tls settings changed (needs a restart, certificates are reloaded when their files change)")
+	}
+	return pending
+}
+
+// Diff lists in a readable way what changes between two configs, nothing if they are the same.
+// The changes listed by Pending aren't part of it.
+func Diff(old *ProxyConfig, next *ProxyConfig) []string {
+	var changes []string
+	changed := func(format string, args ...any) {
+		changes = append(changes, fmt.Sprintf(format, args...))
+	}
+
+	if old.Port != next.Port {
+		changed("port: %d -> %d", old.Port, next.Port)
+	}
+	if old.AdminPort != next.AdminPort {
+		changed("admin port: %d -> %d", old.AdminPort, next.AdminPort)
+	}
+	if old.ShutdownTimeout != next.ShutdownTimeout {
+		changed("shutdown timeout: %v -> %v", old.ShutdownTimeout, next.ShutdownTimeout)
+	}
+	if old.AccessLog != next.AccessLog {
+		changed("access log settings changed")
+	}
+	if !reflect.DeepEqual(old.Forwarding, next.Forwarding) {
+		changed("forwarding settings changed")
+	}
+	if !reflect.DeepEqual(old.ProxyProtocol, next.ProxyProtocol) {
+		changed("proxy protocol settings changed")
+	}
+	if old.RequestID != next.RequestID {
+		changed("request id settings changed")
+	}
+	if old.StateFile != next.StateFile {
+		changed("state file: %q -> %q", old.StateFile, next.StateFile)
+	}
+
+	oldPools := map[string]PoolConfig{}
+	for _, p := range old.AllPools() {
+		oldPools[p.Name] = p
+	}
+	nextPools := map[string]bool{}
+	for _, p := range next.AllPools() {
+		nextPools[p.Name] = true
+		previous, ok := oldPools[p.Name]
+		if !ok {
+			changed("pool %s added", p.Name)
+			continue
+		}
+		changes = append(changes, diffPool(previous, p)...)
+	}
+	for _, p := range old.AllPools() {
+		if !nextPools[p.Name] {
+			changed("pool %s removed", p.Name)
+		}
+	}
+
+	if !reflect.DeepEqual(old.Routes, next.Routes) {
+		changed("routes changed")
+	}
+	return changes
+}
+
+func diffPool(old PoolConfig, next PoolConfig) []string {
+	var changes []string
+	changed := func(format string, args ...any) {
+		changes = append(changes, fmt.Sprintf("pool %s: ", next.Name)+fmt.Sprintf(format, args...))
+	}
+
+	if old.Strategy != next.Strategy || old.HashKey != next.HashKey {
+		changed("strategy %s -> %s", describeStrategy(old), describeStrategy(next))
+	}
+	if old.HealthCheckFreq != next.HealthCheckFreq {
+		changed("health check frequency %v -> %v", time.Duration(old.HealthCheckFreq), time.Duration(next.HealthCheckFreq))
+	}
+	if !reflect.DeepEqual(old.HealthCheck, next.HealthCheck) {
+		changed("health check settings changed")
+	}
+	if !reflect.DeepEqual(old.UpstreamTLS, next.UpstreamTLS) {
+		changed("upstream TLS settings changed")
+	}
+	if !reflect.DeepEqual(old.Transport, next.Transport) {
+		changed("transport settings changed")
+	}
+	if old.StickySessions != next.StickySessions {
+		changed("sticky sessions settings changed")
+	}
+	if !reflect.DeepEqual(old.Retry, next.Retry) {
+		changed("retry settings changed")
+	}
+	if old.OutlierDetection != next.OutlierDetection {
+		changed("outlier detection settings changed")
+	}
+	if old.CircuitBreaker != next.CircuitBreaker {
+		changed("circuit breaker settings changed")
+	}
+	if !reflect.DeepEqual(old.CORS, next.CORS) {
+		changed("CORS policy changed")
+	}
+	if !reflect.DeepEqual(old.HeaderRules, next.HeaderRules) {
+		changed("header rules changed")
+	}
+	if old.RateLimit != next.RateLimit {
+		changed("rate limit %s -> %s", describeRateLimit(old.RateLimit), describeRateLimit(next.RateLimit))
+	}
+
+	oldBackends := map[string]BackendConfig{}
+	for _, b := range old.Backends {
+		oldBackends[b.URL] = b
+	}
+	nextBackends := map[string]bool{}
+	for _, b := range next.Backends {
+		nextBackends[b.URL] = true
+		previous, ok := oldBackends[b.URL]
+		switch {
+		case !ok:
+			changed("backend %s added", b.URL)
+		case previous.Weight != b.Weight:
+			changed("backend %s weight %d -> %d", b.URL, previous.Weight, b.Weight)
+		case !reflect.DeepEqual(previous.Tags, b.Tags):
+			changed("backend %s tags %v -> %v", b.URL, previous.Tags, b.Tags)
+		case previous.Draining != b.Draining:
+			changed("backend %s draining %v -> %v", b.URL, previous.Draining, b.Draining)
+		case !reflect.DeepEqual(previous.HealthCheck, b.HealthCheck):
+			changed("backend %s health check changed", b.URL)
+		case !reflect.DeepEqual(previous.TLS, b.TLS):
+			changed("backend %s TLS settings changed", b.URL)
+		}
+	}
+	for _, b := range old.Backends {
+		if !nextBackends[b.URL] {
+			changed("backend %s removed", b.URL)
+		}
+	}
+	return changes
+}
+
+func describeStrategy(p PoolConfig) string {
+	if p.HashKey == "" {
+		return p.Strategy
+	}
+	return p.Strategy + " (" + p.HashKey + ")"
+}
+
+func describeRateLimit(r RateLimitConfig) string {
+	if !r.Enabled() {
+		return "off"
+	}
+	key := r.Key
+	if key == "" {
+		key = "ip"
+	}
+	return fmt.Sprintf("%g/s burst %d by %s", r.Rate, r.Burst, key)
+}
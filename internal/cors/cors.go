@@ -0,0 +1,227 @@
+package cors
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+	"github.com/ibhiyassine/GoKnot/internal/requestid"
+)
+
+// Methods allowed when the policy doesn't list any, the ones a browser sends without a preflight
+var DEFAULT_METHODS = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+type ownedKey struct{}
+
+// Policy answers the CORS preflights and adds the CORS headers to the responses, in place of the backends.
+// In pass-through mode it does nothing, preflights and headers are left to the backends.
+type Policy struct {
+	PassThrough  bool
+	anyOrigin    bool
+	origins      map[string]bool
+	wildcards    []wildcard
+	regexes      []*regexp.Regexp
+	methods      []string
+	anyHeader    bool
+	headers      []string // lower case
+	allowMethods string
+	allowHeaders string
+	expose       string
+	credentials  bool
+	maxAge       string
+}
+
+// wildcard is an origin like https://*.example.com, the star standing for one or more subdomains
+type wildcard struct {
+	prefix string
+	suffix string
+}
+
+func New(cfg config.CORSConfig) (*Policy, error) {
+	p := &Policy{
+		PassThrough: cfg.PassThrough,
+		origins:     make(map[string]bool),
+		credentials: cfg.AllowCredentials,
+		expose:      strings.Join(cfg.ExposedHeaders, ", "),
+	}
+	if p.PassThrough {
+		return p, nil
+	}
+
+	for _, origin := range cfg.AllowedOrigins {
+		switch {
+		case origin == "*":
+			p.anyOrigin = true
+		case strings.HasPrefix(origin, "regex:"):
+			// Matched against the whole origin, https://app.example.com.evil.com must not pass for https://app\.example\.com
+			re, err := regexp.Compile(`^(?:` + strings.TrimPrefix(origin, "regex:") + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("cors origin %q: %w", origin, err)
+			}
+			p.regexes = append(p.regexes, re)
+		case strings.Contains(origin, "*"):
+			prefix, suffix, _ := strings.Cut(strings.ToLower(origin), "*")
+			if strings.Contains(suffix, "*") {
+				return nil, fmt.Errorf("cors origin %q: only one * is allowed", origin)
+			}
+			p.wildcards = append(p.wildcards, wildcard{prefix: prefix, suffix: suffix})
+		default:
+			p.origins[strings.ToLower(origin)] = true
+		}
+	}
+
+	p.methods = DEFAULT_METHODS
+	if len(cfg.AllowedMethods) > 0 {
+		p.methods = nil
+		for _, m := range cfg.AllowedMethods {
+			p.methods = append(p.methods, strings.ToUpper(m))
+		}
+	}
+	p.allowMethods = strings.Join(p.methods, ", ")
+
+	for _, h := range cfg.AllowedHeaders {
+		if h == "*" {
+			p.anyHeader = true
+			continue
+		}
+		p.headers = append(p.headers, strings.ToLower(h))
+	}
+	p.allowHeaders = strings.Join(cfg.AllowedHeaders, ", ")
+
+	if cfg.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(int(time.Duration(cfg.MaxAge).Seconds()))
+	}
+	return p, nil
+}
+
+// Handle applies the policy to the request. It returns true when the request was a preflight
+// and got its answer, it must not go further then.
+func (p *Policy) Handle(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if p.PassThrough {
+		return r, false
+	}
+	// From here the CORS headers are ours, the ones of the backend are dropped
+	r = r.WithContext(context.WithValue(r.Context(), ownedKey{}, true))
+
+	h := w.Header()
+	origin := r.Header.Get("Origin")
+	if !p.anyOrigin || p.credentials {
+		// The answer depends on the origin, caches must not give it to another one
+		h.Add("Vary", "Origin")
+	}
+	if origin == "" {
+		// Not a cross origin request
+		return r, false
+	}
+
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	if !preflight {
+		if p.allowedOrigin(origin) {
+			p.setOrigin(h, origin)
+			if p.expose != "" {
+				h.Set("Access-Control-Expose-Headers", p.expose)
+			}
+		}
+		// A refused origin still gets the response, the browser won't let it read it
+		return r, false
+	}
+
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	method := r.Header.Get("Access-Control-Request-Method")
+	requested := r.Header.Get("Access-Control-Request-Headers")
+	if !p.allowedOrigin(origin) || !slices.Contains(p.methods, method) || !p.allowedHeaders(requested) {
+		requestid.Error(w, r, "CORS request not allowed", http.StatusForbidden)
+		return r, true
+	}
+
+	p.setOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", p.allowMethods)
+	if p.anyHeader && requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+	} else if p.allowHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", p.allowHeaders)
+	}
+	if p.maxAge != "" {
+		h.Set("Access-Control-Max-Age", p.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return r, true
+}
+
+// Owned tells if a policy took care of the CORS headers of the request
+func Owned(r *http.Request) bool {
+	owned, _ := r.Context().Value(ownedKey{}).(bool)
+	return owned
+}
+
+// StripHeaders removes the CORS headers of a backend response, the client would get them twice otherwise
+func StripHeaders(h http.Header) {
+	for name := range h {
+		if strings.HasPrefix(name, "Access-Control-") {
+			delete(h, name)
+		}
+	}
+}
+
+func (p *Policy) setOrigin(h http.Header, origin string) {
+	if p.anyOrigin && !p.credentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		// Browsers refuse "*" along with credentials
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (p *Policy) allowedOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	for _, re := range p.regexes {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, w := range p.wildcards {
+		if len(origin) > len(w.prefix)+len(w.suffix) && strings.HasPrefix(origin, w.prefix) && strings.HasSuffix(origin, w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHeaders checks the comma separated list of a preflight, the simple headers don't need to be allowed
+func (p *Policy) allowedHeaders(requested string) bool {
+	if p.anyHeader || requested == "" {
+		return true
+	}
+	for _, name := range strings.Split(requested, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || simpleHeaders[name] {
+			continue
+		}
+		if !slices.Contains(p.headers, name) {
+			return false
+		}
+	}
+	return true
+}
+
+var simpleHeaders = map[string]bool{
+	"accept":           true,
+	"accept-language":  true,
+	"content-language": true,
+}
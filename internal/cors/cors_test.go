@@ -0,0 +1,27 @@
+package cors
+
+import (
+	"testing"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+)
+
+func TestRegexOriginMatchesWholeOrigin(t *testing.T) {
+	p, err := New(config.CORSConfig{AllowedOrigins: []string{`regex:https://[a-z]+\.example\.com`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"https://app.example.com":                true,
+		"https://app.example.com.evil.com":       false, // suffix attack
+		"https://evil.com/https://a.example.com": false,
+		"http://app.example.com":                 false,
+		"https://app.example.com:8443":           false,
+	}
+	for origin, want := range cases {
+		if got := p.allowedOrigin(origin); got != want {
+			t.Errorf("allowedOrigin(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
@@ -1,15 +1,63 @@
 package domain
 
 import (
+	"math"
+	"net/http"
 	"net/url"
 	"sync"
+	"time"
 )
 
+// DEFAULT_WEIGHT is used when a backend is registered without a weight
+const DEFAULT_WEIGHT int = 1
+
+// How fast the latency average forgets old samples
+const LATENCY_DECAY time.Duration = 10 * time.Second
+
 type Backend struct {
 	URL          *url.URL `json:"url"`
 	Alive        bool     `json:"alive"`
 	CurrentConns int64    `json:"current_connections"`
+	Weight       int      `json:"weight"`
 	mux          sync.RWMutex
+
+	// Moving average of the response latency, in nanoseconds
+	latencyEWMA  float64
+	lastObserved time.Time
+
+	// Outlier ejection, decided from the live traffic and separate from the health checks
+	ejectedUntil time.Time
+	ejections    int
+
+	// A draining backend keeps its current connections but doesn't receive new ones
+	draining bool
+
+	// Free labels given in the config or the admin API, e.g. "zone=eu" or "canary"
+	tags []string
+
+	// nil when the pool has no circuit breaker
+	Breaker *CircuitBreaker `json:"-"`
+
+	// Used to reach the backend (requests and health checks), nil means http.DefaultTransport
+	Transport *http.Transport `json:"-"`
+
+	// Reverse proxy to the backend, kept for its whole life so connections are reused
+	Proxy http.Handler `json:"-"`
+}
+
+// Close drops the idle connections to the backend once it left its pool, the in-flight requests finish normally
+func (b *Backend) Close() {
+	if b.Transport != nil {
+		b.Transport.CloseIdleConnections()
+	}
+}
+
+// RoundTripper returns the transport of the backend, never a nil one
+func (b *Backend) RoundTripper() http.RoundTripper {
+	if b.Transport == nil {
+		return http.DefaultTransport
+	}
+	return b.Transport
 }
 
 func (b *Backend) SetAlive(alive bool) {
@@ -24,6 +72,84 @@ func (b *Backend) IsAlive() bool {
 	return b.Alive
 }
 
+// IsAvailable tells if the backend can receive new requests,
+// this is what the strategies look at when picking a peer
+func (b *Backend) IsAvailable() bool {
+	b.mux.RLock()
+	available := b.Alive && !b.draining && !time.Now().Before(b.ejectedUntil)
+	b.mux.RUnlock()
+	return available && b.Breaker.Ready()
+}
+
+// Eject takes the backend out of rotation until the given time, the ejection ends by itself
+func (b *Backend) Eject(until time.Time) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.ejectedUntil = until
+	b.ejections++
+}
+
+func (b *Backend) IsEjected() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return time.Now().Before(b.ejectedUntil)
+}
+
+// EjectionInfo returns the end of the last ejection and how many times the backend was ejected
+func (b *Backend) EjectionInfo() (time.Time, int) {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.ejectedUntil, b.ejections
+}
+
+// ResetEjections forgets about the past ejections, the next one will be short again
+func (b *Backend) ResetEjections() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.ejections = 0
+}
+
+func (b *Backend) SetDraining(draining bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.draining = draining
+}
+
+func (b *Backend) IsDraining() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.draining
+}
+
+func (b *Backend) SetWeight(weight int) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.Weight = weight
+}
+
+func (b *Backend) SetTags(tags []string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.tags = tags
+}
+
+func (b *Backend) GetTags() []string {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.tags
+}
+
+// GetWeight never returns less than 1, a backend that was created without a weight
+// still has to receive its share of the traffic
+func (b *Backend) GetWeight() int {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	if b.Weight < 1 {
+		return DEFAULT_WEIGHT
+	}
+	return b.Weight
+}
+
 func (b *Backend) IncrementConns() {
 	b.mux.Lock()
 	defer b.mux.Unlock()
@@ -35,3 +161,35 @@ func (b *Backend) DecrementConns() {
 	defer b.mux.Unlock()
 	b.CurrentConns--
 }
+
+// RecordLatency feeds the latency average with a completed request.
+// It is a "peak" EWMA: a slower sample than the average is taken as is,
+// so a backend that starts degrading gets penalized right away and recovers slowly.
+func (b *Backend) RecordLatency(rtt time.Duration) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	now := time.Now()
+	sample := float64(rtt)
+	if b.lastObserved.IsZero() || sample > b.latencyEWMA {
+		b.latencyEWMA = sample
+	} else {
+		// The older the last sample, the less it counts
+		elapsed := now.Sub(b.lastObserved)
+		w := math.Exp(-float64(elapsed) / float64(LATENCY_DECAY))
+		b.latencyEWMA = b.latencyEWMA*w + sample*(1-w)
+	}
+	b.lastObserved = now
+}
+
+func (b *Backend) GetLatency() time.Duration {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return time.Duration(b.latencyEWMA)
+}
+
+func (b *Backend) GetConns() int64 {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.CurrentConns
+}
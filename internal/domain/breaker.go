@@ -0,0 +1,204 @@
+package domain
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// How many transitions are kept to be shown by the admin API
+const MAX_TRANSITIONS int = 10
+
+type Transition struct {
+	From BreakerState `json:"from"`
+	To   BreakerState `json:"to"`
+	At   time.Time    `json:"at"`
+}
+
+// CircuitBreaker stops sending requests to a backend that fails or is too slow:
+//   - closed: requests go through, and are counted over a window
+//   - open: nothing goes through until OpenTimeout is over
+//   - half-open: only HalfOpenProbes requests go through, if they all succeed the breaker closes, one failure opens it again
+//
+// All the methods work on a nil breaker, which lets everything through
+type CircuitBreaker struct {
+	Name           string        // used in the logs
+	FailureRatio   float64       // between 0 and 1
+	SlowThreshold  time.Duration // slower requests count as failures, 0 disables it
+	MinRequests    int           // requests needed in the window before the ratio counts
+	Window         time.Duration
+	OpenTimeout    time.Duration
+	HalfOpenProbes int
+
+	mux            sync.Mutex
+	state          BreakerState
+	openedAt       time.Time
+	windowStart    time.Time
+	total          int
+	failures       int
+	probesInFlight int
+	probeSuccesses int
+	generation     uint64 // bumped on every transition
+	transitions    []Transition
+}
+
+// Admission is given by Acquire to a request it lets through, and handed back to Record or Release.
+// It remembers the state that let the request in: a request admitted before a transition
+// says nothing about the new state, and only the requests admitted in half-open are probes.
+type Admission struct {
+	generation uint64
+	probe      bool
+}
+
+// Ready tells if a request could go through, without taking a half-open slot.
+// This is what the strategies look at, Acquire is called once the peer is chosen.
+func (cb *CircuitBreaker) Ready() bool {
+	if cb == nil {
+		return true
+	}
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	switch cb.state {
+	case BreakerOpen:
+		return time.Since(cb.openedAt) >= cb.OpenTimeout
+	case BreakerHalfOpen:
+		return cb.probesInFlight < cb.HalfOpenProbes
+	}
+	return true
+}
+
+// Acquire lets a request through, in half-open it takes one of the probe slots
+func (cb *CircuitBreaker) Acquire() (Admission, bool) {
+	if cb == nil {
+		return Admission{}, true
+	}
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	if cb.state == BreakerOpen {
+		if time.Since(cb.openedAt) < cb.OpenTimeout {
+			return Admission{}, false
+		}
+		cb.transition(BreakerHalfOpen)
+	}
+	if cb.state == BreakerHalfOpen {
+		if cb.probesInFlight >= cb.HalfOpenProbes {
+			return Admission{}, false
+		}
+		cb.probesInFlight++
+		return Admission{generation: cb.generation, probe: true}, true
+	}
+	return Admission{generation: cb.generation}, true
+}
+
+// Record feeds the breaker with the outcome of a request that went through Acquire
+func (cb *CircuitBreaker) Record(adm Admission, success bool, latency time.Duration) {
+	if cb == nil {
+		return
+	}
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	// Requests let through before the last transition (like the ones finishing while open) don't change anything,
+	// the state they were admitted in is gone
+	if adm.generation != cb.generation {
+		return
+	}
+	if cb.SlowThreshold > 0 && latency > cb.SlowThreshold {
+		success = false
+	}
+
+	switch cb.state {
+	case BreakerHalfOpen:
+		cb.probesInFlight--
+		if !success {
+			cb.transition(BreakerOpen)
+			return
+		}
+		cb.probeSuccesses++
+		if cb.probeSuccesses >= cb.HalfOpenProbes {
+			cb.transition(BreakerClosed)
+		}
+
+	case BreakerClosed:
+		now := time.Now()
+		if now.Sub(cb.windowStart) > cb.Window {
+			cb.windowStart, cb.total, cb.failures = now, 0, 0
+		}
+		cb.total++
+		if !success {
+			cb.failures++
+		}
+		if cb.total >= cb.MinRequests && float64(cb.failures) >= cb.FailureRatio*float64(cb.total) && cb.failures > 0 {
+			cb.transition(BreakerOpen)
+		}
+	}
+}
+
+// Release gives back what Acquire took for a request that ended without telling anything about the backend,
+// like one abandoned by its client
+func (cb *CircuitBreaker) Release(adm Admission) {
+	if cb == nil {
+		return
+	}
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	if adm.probe && adm.generation == cb.generation {
+		cb.probesInFlight--
+	}
+}
+
+// State returns the current state and the last transitions, oldest first
+func (cb *CircuitBreaker) State() (BreakerState, []Transition) {
+	if cb == nil {
+		return BreakerClosed, nil
+	}
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	return cb.state, append([]Transition(nil), cb.transitions...)
+}
+
+// transition must be called with the lock held
+func (cb *CircuitBreaker) transition(to BreakerState) {
+	log.Printf("[Breaker] %s: %s -> %s", cb.Name, cb.state, to)
+
+	cb.transitions = append(cb.transitions, Transition{From: cb.state, To: to, At: time.Now()})
+	if len(cb.transitions) > MAX_TRANSITIONS {
+		cb.transitions = cb.transitions[1:]
+	}
+
+	cb.state = to
+	cb.generation++
+	switch to {
+	case BreakerOpen:
+		cb.openedAt = time.Now()
+	case BreakerHalfOpen:
+		cb.probesInFlight, cb.probeSuccesses = 0, 0
+	case BreakerClosed:
+		cb.windowStart, cb.total, cb.failures = time.Now(), 0, 0
+	}
+}
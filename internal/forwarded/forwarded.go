@@ -0,0 +1,288 @@
+package forwarded
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+)
+
+type clientKey struct{}
+
+// Resolver finds the real client of a request. The X-Forwarded-* and Forwarded headers are only
+// believed when the connection comes from a trusted proxy, anyone else could write them.
+type Resolver struct {
+	trusted   []netip.Prefix
+	Forwarded bool // also send the RFC 7239 Forwarded header to the backends
+}
+
+// Client is what is known about the client of a request
+type Client struct {
+	IP      string // of the client, behind the trusted proxies
+	Proto   string // http or https, as asked by the client
+	Host    string // as asked by the client
+	Peer    string // IP of the connection, the client itself or the last proxy
+	Trusted bool   // the peer is a trusted proxy, its headers were used
+
+	peerPort  int
+	hopProto  string // what the peer asked us, for our Forwarded element
+	hopHost   string
+	hops      []string // addresses of a trusted Forwarded header, for the X-Forwarded-For of the backend
+	forwarded bool
+}
+
+func New(cfg config.ForwardingConfig) (*Resolver, error) {
+	res := &Resolver{Forwarded: cfg.Forwarded}
+	for _, entry := range cfg.TrustedProxies {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, errors.New("Invalid trusted proxy " + entry + ", use an IP or a CIDR")
+			}
+			res.trusted = append(res.trusted, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, errors.New("Invalid trusted proxy " + entry + ", use an IP or a CIDR")
+		}
+		res.trusted = append(res.trusted, prefix.Masked())
+	}
+	return res, nil
+}
+
+// Resolve works out the client of the request and keeps it in the context of the returned request.
+// A nil resolver trusts nobody.
+func (res *Resolver) Resolve(r *http.Request) *http.Request {
+	if FromContext(r.Context()) != nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), clientKey{}, res.resolve(r)))
+}
+
+func (res *Resolver) resolve(r *http.Request) *Client {
+	peer := hostOnly(r.RemoteAddr)
+	c := &Client{IP: peer, Peer: peer, Proto: "http", Host: r.Host}
+	if _, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		c.peerPort, _ = strconv.Atoi(port)
+	}
+	if r.TLS != nil {
+		c.Proto = "https"
+	}
+	c.hopProto, c.hopHost = c.Proto, c.Host
+	if res == nil {
+		return c
+	}
+	c.forwarded = res.Forwarded
+	if !res.isTrusted(peer) {
+		return c
+	}
+	c.Trusted = true
+
+	// The standard header wins over the X-Forwarded-* ones when both are there
+	var hops []string
+	var protos, hosts []string
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		for _, element := range parseForwarded(strings.Join(values, ",")) {
+			hops = append(hops, element["for"])
+			protos = append(protos, element["proto"])
+			hosts = append(hosts, element["host"])
+		}
+		if len(r.Header.Values("X-Forwarded-For")) == 0 {
+			for _, hop := range hops {
+				c.hops = append(c.hops, hostOnly(hop))
+			}
+		}
+	} else {
+		hops = splitList(r.Header.Values("X-Forwarded-For"))
+		protos = splitList(r.Header.Values("X-Forwarded-Proto"))
+		hosts = splitList(r.Header.Values("X-Forwarded-Host"))
+	}
+
+	// From the nearest hop to the farthest, the client is the first one we don't trust
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := hostOnly(hops[i])
+		if _, err := netip.ParseAddr(ip); err != nil {
+			// "unknown" or obfuscated, nothing further can be believed
+			break
+		}
+		client = ip
+		if !res.isTrusted(ip) {
+			break
+		}
+	}
+	c.IP = client
+
+	// Proto and host are the ones given by the nearest proxy stating them
+	if proto := last(protos); proto == "http" || proto == "https" {
+		c.Proto = proto
+	}
+	if host := last(hosts); host != "" {
+		c.Host = host
+	}
+	return c
+}
+
+// Of returns the client of the request, worked out without trusting anyone if Resolve wasn't called
+func Of(r *http.Request) *Client {
+	if c := FromContext(r.Context()); c != nil {
+		return c
+	}
+	return (*Resolver)(nil).resolve(r)
+}
+
+// FromContext returns the client kept by Resolve, nil if there is none
+func FromContext(ctx context.Context) *Client {
+	c, _ := ctx.Value(clientKey{}).(*Client)
+	return c
+}
+
+// ClientIP is the IP of the client, to be used for anything keyed by client
+func ClientIP(r *http.Request) string {
+	return Of(r).IP
+}
+
+// Addr is the address of the client, with the port of the connection when the client came straight to us
+// and 0 otherwise. It is nil when the IP can't be parsed.
+func (c *Client) Addr() *net.TCPAddr {
+	ip, err := netip.ParseAddr(c.IP)
+	if err != nil {
+		return nil
+	}
+	port := 0
+	if c.IP == c.Peer {
+		port = c.peerPort
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port)))
+}
+
+// SetHeaders writes the forwarding headers of the request sent to the backend.
+// The X-Forwarded-For of a trusted peer is kept, the reverse proxy then appends the peer to it.
+func (c *Client) SetHeaders(h http.Header) {
+	if !c.Trusted {
+		h.Del("X-Forwarded-For")
+	} else if len(c.hops) > 0 {
+		// The previous proxies only sent Forwarded
+		h.Set("X-Forwarded-For", strings.Join(c.hops, ", "))
+	}
+	h.Set("X-Forwarded-Proto", c.Proto)
+	h.Set("X-Forwarded-Host", c.Host)
+	h.Set("X-Real-IP", c.IP)
+
+	previous := ""
+	if c.Trusted {
+		previous = strings.Join(h.Values("Forwarded"), ", ")
+	}
+	h.Del("Forwarded")
+	if !c.forwarded {
+		if previous != "" {
+			h.Set("Forwarded", previous)
+		}
+		return
+	}
+	element := "for=" + quoteNode(c.Peer) + ";host=" + quote(c.hopHost) + ";proto=" + c.hopProto
+	if previous != "" {
+		element = previous + ", " + element
+	}
+	h.Set("Forwarded", element)
+}
+
+func (res *Resolver) isTrusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range res.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwarded splits a Forwarded header into its elements, with lower case parameter names
+func parseForwarded(value string) []map[string]string {
+	var elements []map[string]string
+	for _, raw := range splitQuoted(value, ',') {
+		element := map[string]string{}
+		for _, pair := range splitQuoted(raw, ';') {
+			name, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				continue
+			}
+			element[strings.ToLower(name)] = strings.Trim(strings.TrimSpace(val), `"`)
+		}
+		elements = append(elements, element)
+	}
+	return elements
+}
+
+// splitQuoted splits on sep outside of double quotes
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func splitList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// last is the last value that isn't empty
+func last(list []string) string {
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i] != "" {
+			return list[i]
+		}
+	}
+	return ""
+}
+
+// hostOnly drops the port and the brackets of an address, "[2001:db8::1]:4711" gives "2001:db8::1"
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// quoteNode writes an IP the way RFC 7239 wants it, IPv6 in brackets and quotes
+func quoteNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+func quote(s string) string {
+	if strings.ContainsAny(s, `:;,"= `) {
+		return `"` + strings.ReplaceAll(s, `"`, ``) + `"`
+	}
+	return s
+}
@@ -0,0 +1,220 @@
+package headers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+	"github.com/ibhiyassine/GoKnot/internal/forwarded"
+	"github.com/ibhiyassine/GoKnot/internal/requestid"
+)
+
+type rulesKey struct{}
+
+// Rules rewrite the headers of the requests sent to the backends and of their responses,
+// in the order they are declared
+type Rules struct {
+	Request  []*Rule
+	Response []*Rule
+}
+
+// Rule is one change: set, add, remove or rename a header
+type Rule struct {
+	Action string
+	Name   string // for remove, a trailing * removes every header starting with the rest
+	To     string // new name, for rename
+	value  string
+	tmpl   *template.Template // when the value is a template
+}
+
+// Vars are what a templated value can use, like {{.ClientIP}} or {{.Header "User-Agent"}}
+type Vars struct {
+	ClientIP  string
+	RequestID string
+	Method    string
+	Host      string
+	Path      string
+	Scheme    string // http or https, as asked by the client
+	Backend   string // URL of the backend, empty before it is picked
+	Status    int    // of the backend response, 0 for the request rules
+	TLS       *TLSVars
+	header    http.Header
+}
+
+// TLSVars describe the connection of the client, nil over plain HTTP
+type TLSVars struct {
+	Version       string
+	CipherSuite   string
+	ServerName    string
+	ClientSubject string // of the client certificate, empty without one
+}
+
+func New(cfg config.HeaderRulesConfig) (*Rules, error) {
+	rs := &Rules{}
+	var err error
+	if rs.Request, err = parseRules("request", cfg.Request); err != nil {
+		return nil, err
+	}
+	if rs.Response, err = parseRules("response", cfg.Response); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func parseRules(side string, configs []config.HeaderRuleConfig) ([]*Rule, error) {
+	var rules []*Rule
+	for i, rc := range configs {
+		rule := &Rule{Action: strings.ToLower(rc.Action), Name: rc.Name, To: rc.To, value: rc.Value}
+		if rule.Name == "" {
+			return nil, fmt.Errorf("%s header rule %d: missing name", side, i)
+		}
+		switch rule.Action {
+		case "set", "add":
+			if strings.Contains(rc.Value, "{{") {
+				tmpl, err := template.New(rc.Name).Parse(rc.Value)
+				if err != nil {
+					return nil, fmt.Errorf("%s header rule %d: invalid template: %w", side, i, err)
+				}
+				rule.tmpl = tmpl
+			}
+		case "remove":
+		case "rename":
+			if rule.To == "" {
+				return nil, fmt.Errorf("%s header rule %d: rename needs a new name in to", side, i)
+			}
+		default:
+			return nil, fmt.Errorf("%s header rule %d: unknown action %q, use set, add, remove or rename", side, i, rc.Action)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Then returns the rules followed by the other ones, nil when both are empty
+func (rs *Rules) Then(other *Rules) *Rules {
+	if rs == nil {
+		return other
+	}
+	if other == nil {
+		return rs
+	}
+	return &Rules{
+		Request:  append(append([]*Rule{}, rs.Request...), other.Request...),
+		Response: append(append([]*Rule{}, rs.Response...), other.Response...),
+	}
+}
+
+// ApplyRequest rewrites the request about to be sent to the backend, Host included
+func (rs *Rules) ApplyRequest(r *http.Request, vars *Vars) {
+	if rs == nil {
+		return
+	}
+	for _, rule := range rs.Request {
+		if http.CanonicalHeaderKey(rule.Name) == "Host" && rule.Action == "set" {
+			// Go keeps the Host out of the header map
+			r.Host = rule.render(vars)
+			continue
+		}
+		rule.apply(r.Header, vars)
+	}
+}
+
+// ApplyResponse rewrites the response of the backend before it is copied to the client
+func (rs *Rules) ApplyResponse(h http.Header, vars *Vars) {
+	if rs == nil {
+		return
+	}
+	for _, rule := range rs.Response {
+		rule.apply(h, vars)
+	}
+}
+
+func (rule *Rule) apply(h http.Header, vars *Vars) {
+	switch rule.Action {
+	case "set":
+		h.Set(rule.Name, rule.render(vars))
+	case "add":
+		h.Add(rule.Name, rule.render(vars))
+	case "remove":
+		if prefix, ok := strings.CutSuffix(http.CanonicalHeaderKey(rule.Name), "*"); ok {
+			for name := range h {
+				if strings.HasPrefix(name, prefix) {
+					delete(h, name)
+				}
+			}
+			return
+		}
+		h.Del(rule.Name)
+	case "rename":
+		values := h.Values(rule.Name)
+		if len(values) == 0 {
+			return
+		}
+		h.Del(rule.Name)
+		h.Del(rule.To)
+		for _, v := range values {
+			h.Add(rule.To, v)
+		}
+	}
+}
+
+func (rule *Rule) render(vars *Vars) string {
+	if rule.tmpl == nil {
+		return rule.value
+	}
+	var buf bytes.Buffer
+	if err := rule.tmpl.Execute(&buf, vars); err != nil {
+		log.Printf("[Headers] Template of %s failed: %v", rule.Name, err)
+		return ""
+	}
+	// A value can't span several lines
+	return strings.NewReplacer("\r", "", "\n", "").Replace(buf.String())
+}
+
+// NewVars collects what the templates can use about the request, backend is empty if there is none yet
+func NewVars(r *http.Request, backend string) *Vars {
+	client := forwarded.Of(r)
+	vars := &Vars{
+		ClientIP:  client.IP,
+		RequestID: requestid.FromContext(r.Context()),
+		Method:    r.Method,
+		Host:      client.Host,
+		Path:      r.URL.Path,
+		Scheme:    client.Proto,
+		Backend:   backend,
+		header:    r.Header.Clone(),
+	}
+	if r.TLS != nil {
+		vars.TLS = &TLSVars{
+			Version:     tls.VersionName(r.TLS.Version),
+			CipherSuite: tls.CipherSuiteName(r.TLS.CipherSuite),
+			ServerName:  r.TLS.ServerName,
+		}
+		if len(r.TLS.PeerCertificates) > 0 {
+			vars.TLS.ClientSubject = r.TLS.PeerCertificates[0].Subject.String()
+		}
+	}
+	return vars
+}
+
+// Header returns a header of the client request, as it was before the rules
+func (v *Vars) Header(name string) string {
+	return v.header.Get(name)
+}
+
+// WithRules attaches the rules to apply to the request, replacing the ones of the handler
+func WithRules(r *http.Request, rs *Rules) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), rulesKey{}, rs))
+}
+
+// FromContext returns the rules attached with WithRules, nil if there are none
+func FromContext(ctx context.Context) *Rules {
+	rs, _ := ctx.Value(rulesKey{}).(*Rules)
+	return rs
+}
@@ -0,0 +1,183 @@
+package health
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+	"github.com/ibhiyassine/GoKnot/internal/domain"
+)
+
+const (
+	CheckTCP  = "tcp"
+	CheckHTTP = "http"
+)
+
+// How much of the response body is read to match the regex, or drained before closing it
+const MAX_BODY_READ int64 = 64 << 10
+
+// statusRange is an inclusive range of status codes, a single code has min == max
+type statusRange struct {
+	min, max int
+}
+
+// Check describes how a backend is probed and how many probes it takes to change its state
+type Check struct {
+	Type    string
+	Path    string
+	Method  string
+	Headers map[string]string
+	Status  []statusRange
+	Body    *regexp.Regexp
+	Timeout time.Duration // 0 means the timeout of the checker
+	Rise    int           // consecutive successes before a dead backend is alive again
+	Fall    int           // consecutive failures before an alive backend is dead
+}
+
+// NewCheck validates the health check settings of the config
+func NewCheck(cfg config.HealthCheckConfig) (*Check, error) {
+	c := &Check{
+		Type:    strings.ToLower(cfg.Type),
+		Path:    cfg.Path,
+		Method:  strings.ToUpper(cfg.Method),
+		Headers: cfg.Headers,
+		Timeout: time.Duration(cfg.Timeout),
+		Rise:    max(cfg.Rise, 1),
+		Fall:    max(cfg.Fall, 1),
+	}
+
+	switch c.Type {
+	case "":
+		c.Type = CheckTCP
+	case CheckTCP, CheckHTTP:
+	default:
+		return nil, fmt.Errorf("unknown health check type %q", cfg.Type)
+	}
+
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if c.Method == "" {
+		c.Method = http.MethodGet
+	}
+
+	for _, s := range cfg.ExpectedStatus {
+		r, err := parseStatusRange(s)
+		if err != nil {
+			return nil, err
+		}
+		c.Status = append(c.Status, r)
+	}
+	if len(c.Status) == 0 {
+		c.Status = []statusRange{{200, 399}}
+	}
+
+	if cfg.BodyRegex != "" {
+		re, err := regexp.Compile(cfg.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check body regex: %w", err)
+		}
+		c.Body = re
+	}
+	return c, nil
+}
+
+// parseStatusRange accepts "200" or "200-299"
+func parseStatusRange(s string) (statusRange, error) {
+	low, high, isRange := strings.Cut(s, "-")
+	min, err := strconv.Atoi(strings.TrimSpace(low))
+	if err != nil {
+		return statusRange{}, fmt.Errorf("invalid expected status %q", s)
+	}
+	max := min
+	if isRange {
+		max, err = strconv.Atoi(strings.TrimSpace(high))
+		if err != nil || max < min {
+			return statusRange{}, fmt.Errorf("invalid expected status %q", s)
+		}
+	}
+	return statusRange{min, max}, nil
+}
+
+func (c *Check) expects(status int) bool {
+	for _, r := range c.Status {
+		if status >= r.min && status <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+func (hc *HealthChecker) probe(c *Check, backend *domain.Backend) bool {
+	host, scheme := backend.URL.Host, backend.URL.Scheme
+	timeout := hc.Timeout
+	if c.Timeout > 0 {
+		timeout = c.Timeout
+	}
+
+	if c.Type == CheckTCP {
+		// Do a TCP dial and return if it is alive or not
+		addr := host
+		if backend.URL.Port() == "" {
+			// https://backend has no port in its URL, but still one to dial
+			port := "80"
+			if scheme == "https" {
+				port = "443"
+			}
+			addr = net.JoinHostPort(backend.URL.Hostname(), port)
+		}
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		// the dial wasn't succesful
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		return true
+	}
+
+	req, err := http.NewRequest(c.Method, scheme+"://"+host+c.Path, nil)
+	if err != nil {
+		return false
+	}
+	for name, value := range c.Headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+
+	client := &http.Client{
+		// Same TLS settings as the proxied requests
+		Transport: backend.RoundTripper(),
+		Timeout:   timeout,
+		// A redirect is an answer, we don't follow it
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		// What is left is read so the connection goes back to the pool of the backend, a big body is cut instead
+		io.Copy(io.Discard, io.LimitReader(resp.Body, MAX_BODY_READ))
+		resp.Body.Close()
+	}()
+
+	if !c.expects(resp.StatusCode) {
+		return false
+	}
+	if c.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, MAX_BODY_READ))
+		if err != nil || !c.Body.Match(body) {
+			return false
+		}
+	}
+	return true
+}
@@ -2,35 +2,67 @@ package health
 
 import (
 	"log"
-	"net"
 	"net/url"
 	"sync"
 	"time"
 
 	"github.com/ibhiyassine/GoKnot/internal/domain"
 	"github.com/ibhiyassine/GoKnot/internal/loadbalancer"
+	"github.com/ibhiyassine/GoKnot/internal/metrics"
 )
 
 const DEFAULT_TIMEOUT time.Duration = 2 * time.Second
 
+// The check used when none is configured: a single TCP dial decides
+var defaultCheck = &Check{Type: CheckTCP, Rise: 1, Fall: 1}
+
 type HealthChecker struct {
+	Pool     string // name of the pool, used as a metric label
 	Interval time.Duration
 	Timeout  time.Duration
 	LB       loadbalancer.LoadBalancer
-	checking bool // to check if I am currently checking the health
+	Check    *Check // nil means a plain TCP check
+	checking bool   // to check if I am currently checking the health
 	mux      sync.RWMutex
+	stop     chan struct{}
+	stopMux  sync.Mutex // not mux, Stop must not wait for a running check
+
+	// Per backend checks replacing the default one, keyed by URL
+	overrides map[string]*Check
+	// Consecutive results of each backend, keyed by URL
+	streaks   map[string]*streak
+	streakMux sync.Mutex
+}
+
+type streak struct {
+	successes int
+	failures  int
 }
 
 func NewHealthChecker(lb loadbalancer.LoadBalancer, interval time.Duration) *HealthChecker {
 	return &HealthChecker{
-		Interval: interval,
-		LB:       lb,
-		Timeout:  DEFAULT_TIMEOUT,
+		Interval:  interval,
+		LB:        lb,
+		Timeout:   DEFAULT_TIMEOUT,
+		overrides: make(map[string]*Check),
+		streaks:   make(map[string]*streak),
 	}
 }
 
+// SetOverride makes the backend use its own check instead of the default one
+func (hc *HealthChecker) SetOverride(uri *url.URL, check *Check) {
+	hc.streakMux.Lock()
+	defer hc.streakMux.Unlock()
+	hc.overrides[uri.String()] = check
+}
+
 func (hc *HealthChecker) Start() {
 	ticker := time.NewTicker(hc.Interval)
+	// The goroutine keeps its own channel, Stop clears the field while it may be checking
+	stop := make(chan struct{})
+	hc.stopMux.Lock()
+	hc.stop = stop
+	hc.stopMux.Unlock()
 
 	// create a background process
 	go func() {
@@ -39,23 +71,52 @@ func (hc *HealthChecker) Start() {
 			select {
 			case <-ticker.C:
 				hc.checkHealth()
+			case <-stop:
+				ticker.Stop()
+				log.Printf("Health checking stopped")
+				return
 			}
 		}
 	}()
 }
 
+// Stop ends the health checking started by Start, a check already running finishes on its own
+func (hc *HealthChecker) Stop() {
+	hc.stopMux.Lock()
+	defer hc.stopMux.Unlock()
+	if hc.stop != nil {
+		close(hc.stop)
+		hc.stop = nil
+	}
+}
+
 func (hc *HealthChecker) checkHealth() {
 	// If it succeded we can start checking the health
 	// otherwise, it is already locked we can't check right now we just wait for the next call
 	if hc.mux.TryLock() {
 		defer hc.mux.Unlock()
 		wg := sync.WaitGroup{}
+		backends := hc.LB.GetBackends()
+		defer hc.forgetRemoved(backends)
+
 		// Iterate through all the backends
-		for _, backend := range hc.LB.GetBackends() {
+		for _, backend := range backends {
 			wg.Add(1)
 			go func(backend *domain.Backend) {
 				defer wg.Done()
-				alive := hc.ping(backend.URL)
+				check := hc.checkOf(backend.URL)
+				start := time.Now()
+				healthy := hc.probe(check, backend)
+
+				result := "failure"
+				if healthy {
+					result = "success"
+				}
+				metrics.HealthChecks.With(hc.Pool, backend.URL.String(), result).Add(1)
+				metrics.HealthCheckDuration.Observe(time.Since(start), hc.Pool, backend.URL.String())
+
+				// A single probe isn't enough to change the state, it takes rise successes or fall failures
+				alive := hc.track(backend, check, healthy)
 				if backend.IsAlive() != alive {
 					if alive {
 						log.Printf("[Health] Backend %s is UP and RUNNING", backend.URL)
@@ -73,13 +134,60 @@ func (hc *HealthChecker) checkHealth() {
 	}
 }
 
-func (hc *HealthChecker) ping(uri *url.URL) bool {
-	// Do a TCP dial and return if it is alive or not
-	conn, err := net.DialTimeout("tcp", uri.Host, hc.Timeout)
-	// the dial wasn't succesful
-	if err != nil {
+func (hc *HealthChecker) checkOf(uri *url.URL) *Check {
+	hc.streakMux.Lock()
+	defer hc.streakMux.Unlock()
+	if check, ok := hc.overrides[uri.String()]; ok {
+		return check
+	}
+	if hc.Check != nil {
+		return hc.Check
+	}
+	return defaultCheck
+}
+
+// track records the result of a probe and returns the state the backend should be in
+func (hc *HealthChecker) track(backend *domain.Backend, check *Check, healthy bool) bool {
+	hc.streakMux.Lock()
+	defer hc.streakMux.Unlock()
+
+	key := backend.URL.String()
+	s, ok := hc.streaks[key]
+	if !ok {
+		s = &streak{}
+		hc.streaks[key] = s
+	}
+
+	if healthy {
+		s.successes++
+		s.failures = 0
+	} else {
+		s.failures++
+		s.successes = 0
+	}
+
+	alive := backend.IsAlive()
+	if !alive && s.successes >= check.Rise {
+		return true
+	}
+	if alive && s.failures >= check.Fall {
 		return false
 	}
-	defer conn.Close()
-	return true
+	return alive
+}
+
+// forgetRemoved drops the streaks of the backends that are not in the pool anymore
+func (hc *HealthChecker) forgetRemoved(backends []*domain.Backend) {
+	hc.streakMux.Lock()
+	defer hc.streakMux.Unlock()
+
+	present := make(map[string]bool, len(backends))
+	for _, b := range backends {
+		present[b.URL.String()] = true
+	}
+	for key := range hc.streaks {
+		if !present[key] {
+			delete(hc.streaks, key)
+		}
+	}
 }
@@ -0,0 +1,198 @@
+package health
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+	"github.com/ibhiyassine/GoKnot/internal/domain"
+	"github.com/ibhiyassine/GoKnot/internal/loadbalancer"
+	"github.com/ibhiyassine/GoKnot/internal/metrics"
+)
+
+const (
+	DEFAULT_OUTLIER_WINDOW       time.Duration = 10 * time.Second
+	DEFAULT_BASE_EJECTION_TIME   time.Duration = 30 * time.Second
+	DEFAULT_MAX_EJECTION_TIME    time.Duration = 5 * time.Minute
+	DEFAULT_MAX_EJECTION_PERCENT int           = 10
+	DEFAULT_MIN_REQUESTS         int           = 5
+)
+
+// The sliding window is cut in buckets, old buckets get reused once they leave the window
+const windowBuckets = 10
+
+// OutlierDetector is the passive side of health checking: it looks at the live traffic
+// and ejects the backends that fail too much, while the HealthChecker only probes them.
+// An ejected backend is still alive, it just doesn't receive requests until the ejection ends.
+type OutlierDetector struct {
+	Pool                     string // name of the pool, used as a metric label
+	Consecutive5xx           int    // 0 disables the check
+	ConsecutiveGatewayErrors int    // connection failures, 502, 503 and 504. 0 disables the check
+	ErrorRate                int    // percentage of 5xx in the window, 0 disables the check
+	MinRequests              int    // requests needed in the window before the error rate counts
+	Window                   time.Duration
+	BaseEjectionTime         time.Duration // multiplied by the number of times the backend was ejected
+	MaxEjectionTime          time.Duration
+	MaxEjectionPercent       int // at most this share of the pool is ejected at once
+	LB                       loadbalancer.LoadBalancer
+
+	stats map[*domain.Backend]*outlierStats
+	mux   sync.Mutex
+}
+
+type bucket struct {
+	start  time.Time
+	total  int
+	errors int
+}
+
+type outlierStats struct {
+	consecutive5xx     int
+	consecutiveGateway int
+	buckets            [windowBuckets]bucket
+}
+
+func NewOutlierDetector(lb loadbalancer.LoadBalancer, cfg config.OutlierConfig) *OutlierDetector {
+	o := &OutlierDetector{
+		Consecutive5xx:           cfg.Consecutive5xx,
+		ConsecutiveGatewayErrors: cfg.ConsecutiveGatewayErrors,
+		ErrorRate:                cfg.ErrorRate,
+		MinRequests:              cfg.MinRequests,
+		Window:                   time.Duration(cfg.Window),
+		BaseEjectionTime:         time.Duration(cfg.BaseEjectionTime),
+		MaxEjectionTime:          time.Duration(cfg.MaxEjectionTime),
+		MaxEjectionPercent:       cfg.MaxEjectionPercent,
+		LB:                       lb,
+		stats:                    make(map[*domain.Backend]*outlierStats),
+	}
+	if o.MinRequests <= 0 {
+		o.MinRequests = DEFAULT_MIN_REQUESTS
+	}
+	if o.Window <= 0 {
+		o.Window = DEFAULT_OUTLIER_WINDOW
+	}
+	if o.BaseEjectionTime <= 0 {
+		o.BaseEjectionTime = DEFAULT_BASE_EJECTION_TIME
+	}
+	if o.MaxEjectionTime <= 0 {
+		o.MaxEjectionTime = DEFAULT_MAX_EJECTION_TIME
+	}
+	if o.MaxEjectionPercent <= 0 {
+		o.MaxEjectionPercent = DEFAULT_MAX_EJECTION_PERCENT
+	}
+	return o
+}
+
+// Report records the outcome of a request sent to the backend,
+// gatewayErr is set when no response could be obtained at all
+func (o *OutlierDetector) Report(b *domain.Backend, status int, gatewayErr bool) {
+	failed := gatewayErr || status >= 500
+	gateway := gatewayErr || status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	s, ok := o.stats[b]
+	if !ok {
+		s = &outlierStats{}
+		o.stats[b] = s
+	}
+
+	if failed {
+		s.consecutive5xx++
+	} else {
+		s.consecutive5xx = 0
+	}
+	if gateway {
+		s.consecutiveGateway++
+	} else {
+		s.consecutiveGateway = 0
+	}
+	now := time.Now()
+	s.add(now, o.Window, failed)
+
+	if !failed || b.IsEjected() {
+		return
+	}
+
+	var reason string
+	switch {
+	case o.Consecutive5xx > 0 && s.consecutive5xx >= o.Consecutive5xx:
+		reason = "consecutive 5xx"
+	case o.ConsecutiveGatewayErrors > 0 && s.consecutiveGateway >= o.ConsecutiveGatewayErrors:
+		reason = "consecutive gateway errors"
+	case o.ErrorRate > 0:
+		total, errors := s.window(now, o.Window)
+		if total >= o.MinRequests && errors*100 >= o.ErrorRate*total {
+			reason = "error rate"
+		}
+	}
+	if reason != "" {
+		o.eject(b, reason)
+	}
+}
+
+func (o *OutlierDetector) eject(b *domain.Backend, reason string) {
+	backends := o.LB.GetBackends()
+	ejected := 0
+	for _, other := range backends {
+		if other.IsEjected() {
+			ejected++
+		}
+	}
+	// We always allow one ejection, otherwise a small pool could never eject anything
+	if ejected > 0 && (ejected+1)*100 > o.MaxEjectionPercent*len(backends) {
+		log.Printf("[Outlier] Backend %s should be ejected (%s) but %d%% of the pool already is", b.URL, reason, ejected*100/len(backends))
+		return
+	}
+
+	// A backend that behaved for a while starts over with a short ejection
+	until, count := b.EjectionInfo()
+	if count > 0 && time.Since(until) > o.MaxEjectionTime {
+		b.ResetEjections()
+		count = 0
+	}
+	duration := min(o.BaseEjectionTime*time.Duration(count+1), o.MaxEjectionTime)
+	b.Eject(time.Now().Add(duration))
+	metrics.Ejections.With(o.Pool, b.URL.String()).Add(1)
+	log.Printf("[Outlier] Backend %s EJECTED for %v (%s)", b.URL, duration, reason)
+
+	// It comes back with a clean slate, and the removed backends are forgotten
+	o.stats[b] = &outlierStats{}
+	present := make(map[*domain.Backend]bool, len(backends))
+	for _, other := range backends {
+		present[other] = true
+	}
+	for other := range o.stats {
+		if !present[other] {
+			delete(o.stats, other)
+		}
+	}
+}
+
+func (s *outlierStats) add(now time.Time, window time.Duration, failed bool) {
+	size := window / windowBuckets
+	start := now.Truncate(size)
+	bk := &s.buckets[(start.UnixNano()/int64(size))%windowBuckets]
+	if !bk.start.Equal(start) {
+		// This bucket was holding an old slice of time
+		*bk = bucket{start: start}
+	}
+	bk.total++
+	if failed {
+		bk.errors++
+	}
+}
+
+func (s *outlierStats) window(now time.Time, window time.Duration) (total int, errors int) {
+	for _, bk := range s.buckets {
+		if now.Sub(bk.start) < window {
+			total += bk.total
+			errors += bk.errors
+		}
+	}
+	return
+}
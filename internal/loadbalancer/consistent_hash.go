@@ -0,0 +1,152 @@
+package loadbalancer
+
+import (
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ibhiyassine/GoKnot/internal/domain"
+	"github.com/ibhiyassine/GoKnot/internal/forwarded"
+)
+
+// Number of points each backend gets on the ring, the more we have the more even the distribution is
+const DEFAULT_VIRTUAL_NODES int = 160
+
+// Where the hashing key is taken from
+const (
+	HashKeyIP     = "ip"
+	HashKeyPath   = "path"
+	HashKeyHeader = "header"
+	HashKeyCookie = "cookie"
+)
+
+type ringNode struct {
+	hash    uint64
+	backend *domain.Backend
+}
+
+// ConsistentHash is a ring hash with virtual nodes.
+// The same key always lands on the same backend, and adding/removing a backend (or one going dead)
+// only moves the keys that were on it, around 1/N of them.
+type ConsistentHash struct {
+	*ServerPool
+	keySource string // one of the HashKey* constants
+	keyName   string // name of the header or cookie
+	ring      []ringNode
+	ringMux   sync.RWMutex
+}
+
+// NewConsistentHash takes the key as it is written in the config:
+// "ip", "path", "header:<name>" or "cookie:<name>"
+func NewConsistentHash(pool *ServerPool, key string) (*ConsistentHash, error) {
+	source, name, _ := strings.Cut(key, ":")
+	switch source {
+	case "":
+		source = HashKeyIP
+	case HashKeyIP, HashKeyPath:
+	case HashKeyHeader, HashKeyCookie:
+		if name == "" {
+			return nil, errors.New("Hash key " + source + " needs a name, e.g. " + source + ":<name>")
+		}
+	default:
+		return nil, errors.New("Unknown hash key " + key)
+	}
+
+	c := &ConsistentHash{
+		ServerPool: pool,
+		keySource:  source,
+		keyName:    name,
+	}
+	c.buildRing()
+	return c, nil
+}
+
+func (c *ConsistentHash) AddBackend(backend *domain.Backend) {
+	c.ServerPool.AddBackend(backend)
+	c.buildRing()
+}
+
+func (c *ConsistentHash) RemoveBackend(uri *url.URL) {
+	c.ServerPool.RemoveBackend(uri)
+	c.buildRing()
+}
+
+func (c *ConsistentHash) GetNextValidPeer(r *http.Request) (*domain.Backend, error) {
+	c.ringMux.RLock()
+	defer c.ringMux.RUnlock()
+
+	n := len(c.ring)
+	if n == 0 {
+		return nil, errors.New("Pool doesn't contain any backend servers")
+	}
+
+	h := hashOf(c.requestKey(r))
+	start := sort.Search(n, func(i int) bool { return c.ring[i].hash >= h })
+
+	// Walk clockwise until we find an alive backend, so only the keys of a dead backend get remapped
+	for i := range n {
+		node := c.ring[(start+i)%n]
+		if node.backend.IsAvailable() {
+			return node.backend, nil
+		}
+	}
+
+	return nil, errors.New("All servers in pool aren't alive")
+}
+
+func (c *ConsistentHash) buildRing() {
+	// The snapshot is taken under the lock, otherwise two concurrent changes
+	// could store the older one last and leave a backend off the ring
+	c.ringMux.Lock()
+	defer c.ringMux.Unlock()
+
+	backends := c.GetBackends()
+	ring := make([]ringNode, 0, len(backends)*DEFAULT_VIRTUAL_NODES)
+	for _, b := range backends {
+		for i := range DEFAULT_VIRTUAL_NODES {
+			ring = append(ring, ringNode{
+				hash:    hashOf(b.URL.String() + "#" + strconv.Itoa(i)),
+				backend: b,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	c.ring = ring
+}
+
+func (c *ConsistentHash) requestKey(r *http.Request) string {
+	switch c.keySource {
+	case HashKeyPath:
+		return r.URL.Path
+	case HashKeyHeader:
+		if v := r.Header.Get(c.keyName); v != "" {
+			return v
+		}
+	case HashKeyCookie:
+		if cookie, err := r.Cookie(c.keyName); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	// Default, and fallback when the header or the cookie is missing
+	return forwarded.ClientIP(r)
+}
+
+func hashOf(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	// FNV alone clusters keys that only differ by their last bytes ("url#1", "url#2"...)
+	// so we finish with the murmur3 mixer to spread them on the ring
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -1,15 +1,18 @@
 package loadbalancer
 
 import (
+	"net/http"
 	"net/url"
 
 	"github.com/ibhiyassine/GoKnot/internal/domain"
 )
 
 type LoadBalancer interface {
-	GetNextValidPeer() (*domain.Backend, error)
+	// The request is given so strategies can route on it (e.g. consistent hashing), the others just ignore it
+	GetNextValidPeer(r *http.Request) (*domain.Backend, error)
 	AddBackend(backend *domain.Backend)
 	SetBackendStatus(uri *url.URL, alive bool)
+	GetBackend(uri *url.URL) (*domain.Backend, error)
 	GetBackends() []*domain.Backend
 	RemoveBackend(uri *url.URL)
 }
@@ -3,6 +3,7 @@ package loadbalancer
 import (
 	"errors"
 	"math"
+	"net/http"
 	"sync/atomic"
 
 	"github.com/ibhiyassine/GoKnot/internal/domain"
@@ -18,7 +19,7 @@ func NewLeastConnections(pool *ServerPool) *LeastConnections {
 	}
 }
 
-func (l *LeastConnections) GetNextValidPeer() (*domain.Backend, error) {
+func (l *LeastConnections) GetNextValidPeer(_ *http.Request) (*domain.Backend, error) {
 	l.mux.RLock()
 	defer l.mux.RUnlock()
 
@@ -26,7 +27,7 @@ func (l *LeastConnections) GetNextValidPeer() (*domain.Backend, error) {
 	var min int64 = math.MaxInt64
 
 	for _, b := range l.Backends {
-		if !b.IsAlive() {
+		if !b.IsAvailable() {
 			continue
 		}
 		conn := atomic.LoadInt64(&b.CurrentConns)
@@ -0,0 +1,76 @@
+package loadbalancer
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+
+	"github.com/ibhiyassine/GoKnot/internal/domain"
+)
+
+// How many times we draw two backends before giving up and scanning the pool
+const MAX_DRAWS int = 3
+
+// P2CEWMA is the "power of two choices" strategy: draw two random backends and keep the cheaper one.
+// The cost is the latency average multiplied by the in-flight requests, so a backend that is slow
+// but still passes the health check stops receiving most of the traffic.
+// No need to look at every backend for every request like LeastConnections does.
+type P2CEWMA struct {
+	*ServerPool
+}
+
+func NewP2CEWMA(pool *ServerPool) *P2CEWMA {
+	return &P2CEWMA{
+		ServerPool: pool,
+	}
+}
+
+func (p *P2CEWMA) GetNextValidPeer(_ *http.Request) (*domain.Backend, error) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	n := len(p.Backends)
+	if n == 0 {
+		return nil, errors.New("Pool doesn't contain any backend servers")
+	}
+
+	for range MAX_DRAWS {
+		i := rand.IntN(n)
+		j := i
+		if n > 1 {
+			// Second pick is different from the first one
+			j = rand.IntN(n - 1)
+			if j >= i {
+				j++
+			}
+		}
+		a, b := p.Backends[i], p.Backends[j]
+
+		switch {
+		case a.IsAvailable() && b.IsAvailable():
+			if score(b) < score(a) {
+				return b, nil
+			}
+			return a, nil
+		case a.IsAvailable():
+			return a, nil
+		case b.IsAvailable():
+			return b, nil
+		}
+	}
+
+	// Most of the pool is dead, take whatever is still alive
+	for _, b := range p.Backends {
+		if b.IsAvailable() {
+			return b, nil
+		}
+	}
+
+	return nil, errors.New("All servers in pool aren't alive")
+}
+
+func score(b *domain.Backend) float64 {
+	// +1 on both sides so a backend without samples or without connections still gets compared
+	latency := float64(b.GetLatency()) + 1
+	return latency * float64(b.GetConns()+1)
+}
@@ -1,6 +1,7 @@
 package loadbalancer
 
 import (
+	"errors"
 	"net/url"
 	"sync"
 
@@ -28,6 +29,17 @@ func (s *ServerPool) SetBackendStatus(uri *url.URL, alive bool) {
 	}
 }
 
+func (s *ServerPool) GetBackend(uri *url.URL) (*domain.Backend, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	for _, b := range s.Backends {
+		if b.URL.String() == uri.String() {
+			return b, nil
+		}
+	}
+	return nil, errors.New("Backend not found in pool")
+}
+
 func (s *ServerPool) GetBackends() []*domain.Backend {
 	s.mux.RLock()
 	defer s.mux.RUnlock()
@@ -2,6 +2,7 @@ package loadbalancer
 
 import (
 	"errors"
+	"net/http"
 	"sync/atomic"
 
 	"github.com/ibhiyassine/GoKnot/internal/domain"
@@ -19,7 +20,7 @@ func NewRoundRobin(pool *ServerPool) *RoundRobin {
 	}
 }
 
-func (r *RoundRobin) GetNextValidPeer() (*domain.Backend, error) {
+func (r *RoundRobin) GetNextValidPeer(_ *http.Request) (*domain.Backend, error) {
 	r.mux.RLock()
 	defer r.mux.RUnlock()
 
@@ -32,7 +33,7 @@ func (r *RoundRobin) GetNextValidPeer() (*domain.Backend, error) {
 	for range r.Backends {
 		next := atomic.AddUint64(&r.Current, 1)
 		idx := next % uint64(n)
-		if r.Backends[idx].IsAlive() {
+		if r.Backends[idx].IsAvailable() {
 			return r.Backends[idx], nil
 		}
 	}
@@ -0,0 +1,32 @@
+package loadbalancer
+
+import "errors"
+
+// Strats maps the strategy names used in the config to their constructor,
+// the hash key is only used by consistent_hash
+var Strats = map[string]func(pool *ServerPool, hashKey string) (LoadBalancer, error){
+	"round_robin": func(pool *ServerPool, _ string) (LoadBalancer, error) {
+		return NewRoundRobin(pool), nil
+	},
+	"least_connection": func(pool *ServerPool, _ string) (LoadBalancer, error) {
+		return NewLeastConnections(pool), nil
+	},
+	"weighted_round_robin": func(pool *ServerPool, _ string) (LoadBalancer, error) {
+		return NewWeightedRoundRobin(pool), nil
+	},
+	"p2c_ewma": func(pool *ServerPool, _ string) (LoadBalancer, error) {
+		return NewP2CEWMA(pool), nil
+	},
+	"consistent_hash": func(pool *ServerPool, hashKey string) (LoadBalancer, error) {
+		return NewConsistentHash(pool, hashKey)
+	},
+}
+
+// NewStrategy creates a load balancer over a new empty pool
+func NewStrategy(strategy string, hashKey string) (LoadBalancer, error) {
+	newStrategy := Strats[strategy]
+	if newStrategy == nil {
+		return nil, errors.New("Unknown strategy " + strategy)
+	}
+	return newStrategy(&ServerPool{}, hashKey)
+}
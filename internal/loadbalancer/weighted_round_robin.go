@@ -0,0 +1,70 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/ibhiyassine/GoKnot/internal/domain"
+)
+
+// WeightedRoundRobin is the smooth weighted round robin used by nginx.
+// Instead of sending N requests in a row to a backend of weight N, the picks get interleaved
+// e.g. weights {a:5, b:1, c:1} gives a a b a c a a and not a a a a a b c
+type WeightedRoundRobin struct {
+	*ServerPool
+	currentWeights map[*domain.Backend]int
+	wmux           sync.Mutex
+}
+
+func NewWeightedRoundRobin(pool *ServerPool) *WeightedRoundRobin {
+	return &WeightedRoundRobin{
+		ServerPool:     pool,
+		currentWeights: make(map[*domain.Backend]int),
+	}
+}
+
+func (w *WeightedRoundRobin) GetNextValidPeer(_ *http.Request) (*domain.Backend, error) {
+	w.wmux.Lock()
+	defer w.wmux.Unlock()
+	w.mux.RLock()
+	defer w.mux.RUnlock()
+
+	if len(w.Backends) == 0 {
+		return nil, errors.New("Pool doesn't contain any backend servers")
+	}
+
+	// Every alive backend gains its weight, the one with the highest current weight wins
+	// and pays back the total, this is what spreads the picks evenly
+	var best *domain.Backend
+	total := 0
+	for _, b := range w.Backends {
+		if !b.IsAvailable() {
+			continue
+		}
+		// Weights are read on every pick so a change from the admin API applies right away
+		weight := b.GetWeight()
+		w.currentWeights[b] += weight
+		total += weight
+
+		if best == nil || w.currentWeights[b] > w.currentWeights[best] {
+			best = b
+		}
+	}
+
+	if best == nil {
+		return nil, errors.New("All servers in pool aren't alive")
+	}
+	w.currentWeights[best] -= total
+
+	// Forget about the backends that got removed from the pool
+	if len(w.currentWeights) > len(w.Backends) {
+		kept := make(map[*domain.Backend]int, len(w.Backends))
+		for _, b := range w.Backends {
+			kept[b] = w.currentWeights[b]
+		}
+		w.currentWeights = kept
+	}
+
+	return best, nil
+}
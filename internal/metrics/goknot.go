@@ -0,0 +1,58 @@
+package metrics
+
+import "net/http"
+
+// Every metric GoKnot exposes, the backend label is the URL of the backend
+
+var (
+	Requests = NewCounterVec("goknot_requests_total",
+		"Requests sent to the backends, a retried request counts once per attempt. Requests answered by GoKnot itself have an empty backend.",
+		"pool", "backend", "code", "method")
+
+	RequestDuration = NewHistogramVec("goknot_request_duration_seconds",
+		"Time the backends took to answer.",
+		DEFAULT_BUCKETS, "pool", "backend")
+
+	BytesIn = NewCounterVec("goknot_request_bytes_total",
+		"Bytes of request bodies sent to the backends.",
+		"pool", "backend")
+
+	BytesOut = NewCounterVec("goknot_response_bytes_total",
+		"Bytes of response bodies sent back to the clients.",
+		"pool", "backend")
+
+	HealthChecks = NewCounterVec("goknot_health_checks_total",
+		"Health check probes by result.",
+		"pool", "backend", "result")
+
+	HealthCheckDuration = NewHistogramVec("goknot_health_check_duration_seconds",
+		"Time taken by the health check probes.",
+		DEFAULT_BUCKETS, "pool", "backend")
+
+	Retries = NewCounterVec("goknot_retries_total",
+		"Requests sent again to another backend.",
+		"pool")
+
+	Ejections = NewCounterVec("goknot_ejections_total",
+		"Backends ejected by the outlier detection.",
+		"pool", "backend")
+
+	Selections = NewCounterVec("goknot_strategy_selections_total",
+		"Backends picked for a request, by the strategy or by the affinity cookie.",
+		"pool", "strategy", "backend")
+
+	RateLimited = NewCounterVec("goknot_rate_limited_total",
+		"Requests rejected with a 429 by a rate limiter.",
+		"limiter")
+)
+
+// Method is the value of the method label. A client can send any method,
+// the ones that aren't standard share OTHER so they can't add series without limit.
+func Method(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
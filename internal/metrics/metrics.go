@@ -0,0 +1,207 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_BUCKETS are the upper bounds of the histograms, in seconds
+var DEFAULT_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// collector is anything able to write itself in the Prometheus text format
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry holds the metrics exposed on /metrics
+type Registry struct {
+	collectors []collector
+	mux        sync.Mutex
+}
+
+// The registry every GoKnot metric is part of
+var Default = &Registry{}
+
+func (r *Registry) register(c collector) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Write writes every metric of the registry in the Prometheus text exposition format
+func (r *Registry) Write(w io.Writer) {
+	r.mux.Lock()
+	collectors := slices.Clone(r.collectors)
+	r.mux.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// vec is what counters and histograms share: a name, label names and one series per label values.
+// Series are looked up in a sync.Map, so once a series exists recording into it takes no lock.
+type vec struct {
+	name   string
+	help   string
+	labels []string
+	series sync.Map // label values joined by keySeparator -> series
+}
+
+const keySeparator = "\xff"
+
+func (v *vec) load(values []string, create func() any) any {
+	key := strings.Join(values, keySeparator)
+	if s, ok := v.series.Load(key); ok {
+		return s
+	}
+	s, _ := v.series.LoadOrStore(key, create())
+	return s
+}
+
+// each calls fn on the series sorted by their labels, so the output is stable between scrapes
+func (v *vec) each(fn func(labels string, s any)) {
+	var keys []string
+	v.series.Range(func(key, _ any) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		s, _ := v.series.Load(key)
+		fn(v.formatLabels(strings.Split(key, keySeparator)), s)
+	}
+}
+
+func (v *vec) formatLabels(values []string) string {
+	if len(v.labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(v.labels))
+	for i, name := range v.labels {
+		pairs[i] = name + `="` + escape(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (v *vec) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, kind)
+}
+
+// CounterVec is a counter with labels
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec{name: name, help: help, labels: labels}}
+	Default.register(c)
+	return c
+}
+
+// With returns the counter of the label values, given in the order of the label names
+func (c *CounterVec) With(values ...string) *atomic.Uint64 {
+	return c.load(values, func() any { return &atomic.Uint64{} }).(*atomic.Uint64)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.header(w, "counter")
+	c.each(func(labels string, s any) {
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, labels, s.(*atomic.Uint64).Load())
+	})
+}
+
+// HistogramVec is a histogram with labels
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+type histogram struct {
+	counts []atomic.Uint64 // one per bucket, the +Inf bucket is count
+	count  atomic.Uint64
+	sum    atomic.Uint64 // float64 bits
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{vec: vec{name: name, help: help, labels: labels}, buckets: buckets}
+	Default.register(h)
+	return h
+}
+
+// Observe records a duration in the histogram of the label values
+func (h *HistogramVec) Observe(d time.Duration, values ...string) {
+	s := h.load(values, func() any {
+		return &histogram{counts: make([]atomic.Uint64, len(h.buckets))}
+	}).(*histogram)
+
+	seconds := d.Seconds()
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			s.counts[i].Add(1)
+		}
+	}
+	s.count.Add(1)
+	for {
+		old := s.sum.Load()
+		if s.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+seconds)) {
+			break
+		}
+	}
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.header(w, "histogram")
+	h.each(func(labels string, s any) {
+		hist := s.(*histogram)
+		sep := ""
+		if labels != "" {
+			sep = ","
+		}
+		for i, bound := range h.buckets {
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", h.name, labels, sep, le, hist.counts[i].Load())
+		}
+		count := hist.count.Load()
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", h.name, labels, sep, count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", h.name, labels, math.Float64frombits(hist.sum.Load()))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, labels, count)
+	})
+}
+
+// Gauge is a single value read when writing, e.g. the current connections of a backend
+type Gauge struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// WriteGauges writes a gauge computed at scrape time, which is cheaper than keeping it up to date
+func WriteGauges(w io.Writer, name, help string, gauges []Gauge) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, g := range gauges {
+		names := make([]string, 0, len(g.Labels))
+		for k := range g.Labels {
+			names = append(names, k)
+		}
+		slices.Sort(names)
+		pairs := make([]string, len(names))
+		for i, k := range names {
+			pairs[i] = k + `="` + escape(g.Labels[k]) + `"`
+		}
+		fmt.Fprintf(w, "%s{%s} %g\n", name, strings.Join(pairs, ","), g.Value)
+	}
+}
+
+func escape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
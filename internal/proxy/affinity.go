@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/ibhiyassine/GoKnot/internal/domain"
+	"github.com/ibhiyassine/GoKnot/internal/forwarded"
+	"github.com/ibhiyassine/GoKnot/internal/loadbalancer"
+)
+
+const DEFAULT_AFFINITY_COOKIE string = "GOKNOT_AFFINITY"
+
+// Affinity pins a client to a backend with a cookie holding an opaque ID of the backend,
+// a keyed hash of its URL: clients learn nothing about the backends and can't make up the ID of one.
+type Affinity struct {
+	cookieName string
+	secret     []byte
+	ids        sync.Map // backend URL -> ID, so they are only hashed once
+}
+
+// NewAffinity creates a session affinity, when the secret is empty a random one is generated,
+// which means the cookies given before a restart won't be honoured anymore
+func NewAffinity(cookieName, secret string) *Affinity {
+	if cookieName == "" {
+		cookieName = DEFAULT_AFFINITY_COOKIE
+	}
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		rand.Read(key)
+		log.Println("[Affinity] No secret configured, affinity cookies won't survive a restart")
+	}
+	return &Affinity{
+		cookieName: cookieName,
+		secret:     key,
+	}
+}
+
+// Pinned returns the backend with the ID of the affinity cookie,
+// or nil if there is no valid cookie or the backend is gone or dead
+func (a *Affinity) Pinned(r *http.Request, lb loadbalancer.LoadBalancer) *domain.Backend {
+	cookie, err := r.Cookie(a.cookieName)
+	if err != nil {
+		return nil
+	}
+
+	for _, backend := range lb.GetBackends() {
+		if hmac.Equal([]byte(cookie.Value), []byte(a.id(backend))) {
+			if !backend.IsAvailable() {
+				return nil
+			}
+			return backend
+		}
+	}
+	return nil
+}
+
+// Pin sets the affinity cookie on the response so the client comes back to the backend
+func (a *Affinity) Pin(w http.ResponseWriter, r *http.Request, backend *domain.Backend) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.cookieName,
+		Value:    a.id(backend),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   forwarded.Of(r).Proto == "https", // TLS here or at a trusted proxy in front
+
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *Affinity) id(backend *domain.Backend) string {
+	key := backend.URL.String()
+	if id, ok := a.ids.Load(key); ok {
+		return id.(string)
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(key))
+	// 128 bits are plenty to tell the backends apart and to not be guessed
+	id := base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+	a.ids.Store(key, id)
+	return id
+}
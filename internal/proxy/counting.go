@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/ibhiyassine/GoKnot/internal/headers"
+)
+
+// countingWriter counts the bytes of the response body written to the client
+type countingWriter struct {
+	http.ResponseWriter
+	bytes int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	cw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack of the real writer
+func (cw *countingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// countingReader counts the bytes of the request body sent to the backend
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.bytes += int64(n)
+	return n, err
+}
+
+// accessWriter remembers what was answered to the client, and which backend answered it, for the access log
+type accessWriter struct {
+	http.ResponseWriter
+	status         int
+	bytes          int64
+	upstream       string
+	upstreamStatus int
+
+	// The responses of the backends get the response rules in ModifyResponse,
+	// the ones answered by the proxy itself (errors, 429s, redirects...) get them here
+	rules   *headers.Rules
+	request *http.Request
+	ruled   bool // the response comes from a backend, the rules were already applied
+}
+
+func (aw *accessWriter) WriteHeader(code int) {
+	// An informational response isn't the answer, the rules wait for the final one
+	if aw.status == 0 && code >= http.StatusOK {
+		aw.status = code
+		aw.applyRules()
+	}
+	aw.ResponseWriter.WriteHeader(code)
+}
+
+func (aw *accessWriter) Write(p []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+		aw.applyRules()
+	}
+	n, err := aw.ResponseWriter.Write(p)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+func (aw *accessWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+func (aw *accessWriter) applyRules() {
+	if aw.rules == nil || aw.ruled {
+		return
+	}
+	vars := headers.NewVars(aw.request, "")
+	vars.Status = aw.status
+	aw.rules.ApplyResponse(aw.Header(), vars)
+}
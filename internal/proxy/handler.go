@@ -1,16 +1,41 @@
 package proxy
 
 import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
 
+	"github.com/ibhiyassine/GoKnot/internal/accesslog"
+	"github.com/ibhiyassine/GoKnot/internal/cors"
+	"github.com/ibhiyassine/GoKnot/internal/domain"
+	"github.com/ibhiyassine/GoKnot/internal/forwarded"
+	"github.com/ibhiyassine/GoKnot/internal/headers"
+	"github.com/ibhiyassine/GoKnot/internal/health"
 	"github.com/ibhiyassine/GoKnot/internal/loadbalancer"
+	"github.com/ibhiyassine/GoKnot/internal/metrics"
+	"github.com/ibhiyassine/GoKnot/internal/requestid"
 )
 
 type ProxyHandler struct {
 	loadBalancer loadbalancer.LoadBalancer
+	Pool         string // name of the pool and of its strategy, used as metric labels
+	Strategy     string
+	Affinity     *Affinity               // nil when sticky sessions are disabled
+	Retry        *RetryPolicy            // nil when retries are disabled
+	Outliers     *health.OutlierDetector // nil when outlier detection is disabled
+	AccessLog    *accesslog.Logger       // nil when the access log is disabled
+	RequestIDs   *requestid.Generator    // nil gives uuids in X-Request-ID
+	Headers      *headers.Rules          // nil when the headers are left as they are
+	retries      atomic.Int64
 }
 
 func NewProxyHandler(lb loadbalancer.LoadBalancer) *ProxyHandler {
@@ -20,53 +45,261 @@ func NewProxyHandler(lb loadbalancer.LoadBalancer) *ProxyHandler {
 }
 
 func (ph *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Everything logged or answered about the request from here carries its ID
+	r = ph.RequestIDs.Ensure(w, r)
+	w, done := ph.Track(w, r)
+	defer done()
 
-	// This tells the browser: "It's okay to accept requests from any website (*)"
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	peer, err := ph.choosePeer(w, r)
 
-	// 2. Handle Preflight Requests
-	// Browsers sometimes send an empty "OPTIONS" request first to check permissions.
-	// We must respond with "OK" and stop there.
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
+	if err != nil {
+		requestid.Error(w, r, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
-	peer, err := ph.loadBalancer.GetNextValidPeer()
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	admission, ok := peer.Breaker.Acquire()
+	if !ok {
+		// Another request took the last half-open slot of this backend in the meantime
+		peer, admission = ph.nextUntriedPeer(r, map[*domain.Backend]bool{peer: true})
+		if peer == nil {
+			requestid.Error(w, r, "No backend available, circuit breakers are open", http.StatusServiceUnavailable)
+			return
+		}
+		if ph.Affinity != nil {
+			w.Header().Del("Set-Cookie")
+			ph.Affinity.Pin(w, r, peer)
+		}
+	}
+
+	if ph.Retry != nil && ph.Retry.MaxAttempts > 1 {
+		ph.serveWithRetries(w, r, peer, admission)
 		return
 	}
+	ph.forward(w, r, peer, &attempt{admission: admission})
+}
 
+// forward sends the request to the peer, and records how it went in att
+func (ph *ProxyHandler) forward(w http.ResponseWriter, r *http.Request, peer *domain.Backend, att *attempt) {
 	targetURL := peer.URL
-	log.Printf("Proxy requesting to %s", targetURL.String())
+	log.Printf("%sProxy requesting to %s", requestid.Prefix(r), targetURL.String())
 
 	// The peer will get a connection
 	peer.IncrementConns()
 	defer peer.DecrementConns()
 
-	// setup the reverse proxy
-	proxy := ph.getReverseProxy(targetURL)
+	// The reverse proxy of the backend finds the attempt in the context
+	att.ph = ph
+	att.written, _ = w.(*accessWriter)
+	r = r.WithContext(context.WithValue(r.Context(), attemptKey{}, att))
+	proxy := peer.Proxy
+	if proxy == nil {
+		// Backends not created by a pool
+		proxy = NewBackendProxy(peer)
+	}
+
+	// Count what goes through for the metrics
+	cw := &countingWriter{ResponseWriter: w}
+	var cr *countingReader
+	if r.Body != nil && r.Body != http.NoBody {
+		cr = &countingReader{ReadCloser: r.Body}
+		r.Body = cr
+	}
 
 	// The request context is passed
-	proxy.ServeHTTP(w, r)
+	start := time.Now()
+	proxy.ServeHTTP(cw, r)
+
+	// Latency aware strategies need to know how long the backend took
+	latency := time.Since(start)
+	peer.RecordLatency(latency)
+	// A client hanging up says nothing about the backend
+	clientGone := errors.Is(r.Context().Err(), context.Canceled)
+	if clientGone {
+		peer.Breaker.Release(att.admission)
+	} else {
+		peer.Breaker.Record(att.admission, !att.gatewayErr && att.status < http.StatusInternalServerError, latency)
+	}
+
+	backend := targetURL.String()
+	code := "error"
+	if att.status > 0 {
+		code = strconv.Itoa(att.status)
+	}
+	metrics.Requests.With(ph.Pool, backend, code, metrics.Method(r.Method)).Add(1)
+	metrics.RequestDuration.Observe(latency, ph.Pool, backend)
+	metrics.BytesOut.With(ph.Pool, backend).Add(uint64(cw.bytes))
+	if cr != nil {
+		metrics.BytesIn.With(ph.Pool, backend).Add(uint64(cr.bytes))
+	}
+
+	if ph.Outliers != nil && !clientGone {
+		ph.Outliers.Report(peer, att.status, att.gatewayErr)
+	}
+
+	// With retries the last backend tried is the one that counts
+	if aw, ok := w.(*accessWriter); ok {
+		aw.upstream, aw.upstreamStatus = backend, att.status
+	}
+}
+
+// Track starts the access log record of the request, written by the returned func once it is answered.
+// The router calls it first so the requests it answers itself (preflights, 429s, redirects) are logged too,
+// a request already tracked keeps its record. Those requests are counted in the metrics without a backend.
+func (ph *ProxyHandler) Track(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if _, ok := w.(*accessWriter); ok {
+		return w, func() {}
+	}
+	aw := &accessWriter{ResponseWriter: w, rules: ph.headerRules(r), request: r}
+	start := time.Now()
+	return aw, func() {
+		if aw.upstream == "" {
+			// No backend was tried, forward counts the others
+			metrics.Requests.With(ph.Pool, "", strconv.Itoa(cmp.Or(aw.status, http.StatusOK)), metrics.Method(r.Method)).Add(1)
+		}
+		if ph.AccessLog != nil {
+			ph.logAccess(aw, r, start)
+		}
+	}
+}
 
+func (ph *ProxyHandler) logAccess(aw *accessWriter, r *http.Request, start time.Time) {
+	ph.AccessLog.Log(&accesslog.Entry{
+		Time:           start,
+		ClientIP:       forwarded.ClientIP(r),
+		Method:         r.Method,
+		Host:           r.Host,
+		Path:           requestURI(r),
+		Proto:          r.Proto,
+		Status:         aw.status,
+		Bytes:          aw.bytes,
+		BytesIn:        max(r.ContentLength, 0),
+		Duration:       time.Since(start),
+		Pool:           ph.Pool,
+		Upstream:       aw.upstream,
+		UpstreamStatus: aw.upstreamStatus,
+		RequestID:      requestid.FromContext(r.Context()),
+		Referer:        r.Referer(),
+		UserAgent:      r.UserAgent(),
+	})
 }
 
-func (ph *ProxyHandler) getReverseProxy(uri *url.URL) (proxy *httputil.ReverseProxy) {
-	proxy = httputil.NewSingleHostReverseProxy(uri)
+// headerRules are the ones of the route of the request, or of the pool
+func (ph *ProxyHandler) headerRules(r *http.Request) *headers.Rules {
+	if rules := headers.FromContext(r.Context()); rules != nil {
+		return rules
+	}
+	return ph.Headers
+}
+
+// requestURI is the path asked by the client, before any rewrite
+func requestURI(r *http.Request) string {
+	if r.RequestURI != "" {
+		return r.RequestURI
+	}
+	return r.URL.RequestURI()
+}
+
+func (ph *ProxyHandler) choosePeer(w http.ResponseWriter, r *http.Request) (*domain.Backend, error) {
+	if ph.Affinity != nil {
+		// The client is already pinned to a backend that is still alive
+		if peer := ph.Affinity.Pinned(r, ph.loadBalancer); peer != nil {
+			metrics.Selections.With(ph.Pool, "affinity", peer.URL.String()).Add(1)
+			return peer, nil
+		}
+	}
+
+	// No affinity, no cookie, or the pinned backend is gone: let the strategy decide
+	peer, err := ph.loadBalancer.GetNextValidPeer(r)
+	if err != nil {
+		return nil, err
+	}
+	metrics.Selections.With(ph.Pool, ph.Strategy, peer.URL.String()).Add(1)
+
+	// and pin the client again
+	if ph.Affinity != nil {
+		ph.Affinity.Pin(w, r, peer)
+	}
+	return peer, nil
+}
+
+// NewBackendProxy creates the reverse proxy of a backend, it lives as long as the backend.
+// What is specific to a request (its attempt and its handler) comes with the request context.
+func NewBackendProxy(peer *domain.Backend) *httputil.ReverseProxy {
+	uri := peer.URL
+	proxy := httputil.NewSingleHostReverseProxy(uri)
+	// Carries the connection pool and the upstream TLS settings of the backend
+	proxy.Transport = peer.RoundTripper()
+
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		att := attemptOf(req)
+		rules := att.ph.headerRules(req)
+		if rules != nil {
+			// Taken before the URL points to the backend, the templates see the request of the client
+			att.vars = headers.NewVars(req, uri.String())
+		}
+		director(req)
+		// The reverse proxy then appends the peer to X-Forwarded-For
+		forwarded.Of(req).SetHeaders(req.Header)
+		rules.ApplyRequest(req, att.vars)
+	}
+
+	proxy.ModifyResponse = func(res *http.Response) error {
+		att := attemptOf(res.Request)
+		att.status = res.StatusCode
+		// The client already has the ID in the response, a backend echoing it would send it twice
+		res.Header.Del(att.ph.RequestIDs.HeaderName())
+		if cors.Owned(res.Request) {
+			// The CORS policy of the proxy replaces the one of the backend
+			cors.StripHeaders(res.Header)
+		}
+		if rules := att.ph.headerRules(res.Request); rules != nil {
+			att.vars.Status = res.StatusCode
+			rules.ApplyResponse(res.Header, att.vars)
+		}
+
+		// Rejecting the response here means nothing is copied to the client, so it can be retried
+		if att.ph.retryStatus(att, res) {
+			return fmt.Errorf("%w %d", errRetryStatus, res.StatusCode)
+		}
+		if att.written != nil {
+			att.written.ruled = true
+		}
+		return nil
+	}
 
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		att := attemptOf(r)
+		if errors.Is(err, errRetryStatus) {
+			// The backend answered, it is alive
+			att.retry, att.err = true, err
+			return
+		}
+
 		// If this function gets triggered, that means the backend isn't suitable for requests
-		log.Printf("[%s] Connection failed: %v", uri, err)
+		log.Printf("%s[%s] Connection failed: %v", requestid.Prefix(r), uri, err)
+		att.gatewayErr = true
 
-		// It should be marked as dead
-		ph.loadBalancer.SetBackendStatus(uri, false)
+		// Without outlier detection it should be marked as dead right away,
+		// otherwise the detector decides if it deserves an ejection
+		if att.ph.Outliers == nil && r.Context().Err() == nil && connectionFailed(err) {
+			att.ph.loadBalancer.SetBackendStatus(uri, false)
+		}
 
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		if shouldRetryError(att, err) {
+			att.retry, att.err = true, err
+			return
+		}
+		requestid.Error(w, r, err.Error(), http.StatusServiceUnavailable)
 	}
 
-	return
+	return proxy
+}
+
+// connectionFailed tells if the backend couldn't be reached or dropped the connection,
+// a timeout waiting for the response says nothing about the backend being down.
+// Requests abandoned by the client or by their per try timeout are left out by the caller, from their context.
+func connectionFailed(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
 }
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+	"github.com/ibhiyassine/GoKnot/internal/domain"
+	"github.com/ibhiyassine/GoKnot/internal/loadbalancer"
+)
+
+// BenchmarkProxy compares a reverse proxy created for every request over http.DefaultTransport,
+// the way requests were forwarded before, with the one kept for the life of the backend.
+// Both go through the same ProxyHandler, only the backend differs.
+func BenchmarkProxy(b *testing.B) {
+	// One line per request would be most of what is measured
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+	uri, _ := url.Parse(backend.URL)
+
+	b.Run("per_request", func(b *testing.B) {
+		// Without a proxy of its own, the handler creates one for every request
+		peer := &domain.Backend{URL: uri, Alive: true, Weight: domain.DEFAULT_WEIGHT}
+		bench(b, peer)
+	})
+
+	b.Run("per_backend", func(b *testing.B) {
+		peer := &domain.Backend{URL: uri, Alive: true, Weight: domain.DEFAULT_WEIGHT}
+		peer.Transport = NewTransport(nil, config.TransportConfig{})
+		peer.Proxy = NewBackendProxy(peer)
+		defer peer.Close()
+		bench(b, peer)
+	})
+}
+
+func bench(b *testing.B, peer *domain.Backend) {
+	lb, err := loadbalancer.NewStrategy("round_robin", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	lb.AddBackend(peer)
+	ph := NewProxyHandler(lb)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		serve(b, ph)
+	}
+}
+
+func serve(b *testing.B, h http.Handler) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		b.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+}
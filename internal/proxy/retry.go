@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/ibhiyassine/GoKnot/internal/domain"
+	"github.com/ibhiyassine/GoKnot/internal/headers"
+	"github.com/ibhiyassine/GoKnot/internal/metrics"
+	"github.com/ibhiyassine/GoKnot/internal/requestid"
+)
+
+// Biggest request body we keep in memory to replay it on another backend
+const DEFAULT_RETRY_BODY_SIZE int64 = 1 << 20
+
+// Returned by ModifyResponse when the status code of the backend asks for a retry
+var errRetryStatus = errors.New("backend answered with a retryable status")
+
+// RetryPolicy describes when a failed request is sent again to another backend
+type RetryPolicy struct {
+	MaxAttempts   int           // first try included, 1 means no retry
+	PerTryTimeout time.Duration // 0 means no timeout
+	Budget        time.Duration // overall time for all the attempts, 0 means no limit
+	RetryOn       []int         // status codes worth retrying, e.g. 502, 503, 504
+	MaxBodySize   int64         // bodies bigger than this are streamed and can't be retried
+}
+
+// attempt is one try at forwarding a request
+type attempt struct {
+	ph         *ProxyHandler // the handler forwarding the request
+	retryable  bool          // another attempt is allowed and the request can be replayed
+	idempotent bool
+	retry      bool // set when this attempt failed and nothing was written to the client
+	err        error
+	status     int           // status code of the backend, 0 if it didn't answer
+	gatewayErr bool          // the backend couldn't be reached or didn't answer
+	vars       *headers.Vars // for the header rules, nil without any
+	written    *accessWriter // where the response goes, nil when it isn't tracked
+	tried      map[*domain.Backend]bool
+	admission  domain.Admission // given by the breaker of the backend
+	next       *domain.Backend  // taken when the status of the backend asked for a retry
+	nextAdm    domain.Admission
+}
+
+// The attempt travels in the request context to the reverse proxy of the backend
+type attemptKey struct{}
+
+func attemptOf(r *http.Request) *attempt {
+	return r.Context().Value(attemptKey{}).(*attempt)
+}
+
+func (ph *ProxyHandler) serveWithRetries(w http.ResponseWriter, r *http.Request, peer *domain.Backend, admission domain.Admission) {
+	policy := ph.Retry
+
+	// The body has to be kept around to be sent again
+	body, replayable := bufferBody(r, policy.MaxBodySize)
+
+	ctx := r.Context()
+	if policy.Budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Budget)
+		defer cancel()
+	}
+
+	tried := map[*domain.Backend]bool{}
+	for n := 1; ; n++ {
+		tried[peer] = true
+		att := &attempt{
+			retryable:  replayable && n < policy.MaxAttempts,
+			idempotent: isIdempotent(r.Method),
+			tried:      tried,
+			admission:  admission,
+		}
+
+		tryCtx, cancel := ctx, context.CancelFunc(func() {})
+		if policy.PerTryTimeout > 0 {
+			tryCtx, cancel = context.WithTimeout(ctx, policy.PerTryTimeout)
+		}
+		req := r.WithContext(tryCtx)
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		ph.forward(w, req, peer, att)
+		cancel()
+
+		if !att.retry {
+			return
+		}
+
+		// From here nothing was written to the client yet, we either retry or answer the error ourselves.
+		// A retryable status was only rejected because the next peer was already there.
+		next, nextAdm := att.next, att.nextAdm
+		if next == nil && ctx.Err() != nil {
+			requestid.Error(w, r, "Retry budget exhausted: "+att.err.Error(), http.StatusGatewayTimeout)
+			return
+		}
+		if next == nil {
+			next, nextAdm = ph.nextUntriedPeer(r, tried)
+		}
+		if next == nil {
+			requestid.Error(w, r, att.err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		ph.retries.Add(1)
+		metrics.Retries.With(ph.Pool).Add(1)
+		log.Printf("%s[Retry] Attempt %d on %s failed (%v), retrying on %s", requestid.Prefix(r), n, peer.URL, att.err, next.URL)
+		if ph.Affinity != nil {
+			// The client was pinned to the failing backend
+			w.Header().Del("Set-Cookie")
+			ph.Affinity.Pin(w, r, next)
+		}
+		peer, admission = next, nextAdm
+	}
+}
+
+// Retries returns how many requests were sent again to another backend
+func (ph *ProxyHandler) Retries() int64 {
+	return ph.retries.Load()
+}
+
+// retryStatus tells if the response is dropped to be retried, which takes the next peer.
+// Without one, or once the budget is exhausted, the client gets the real response rather than an error of ours.
+func (ph *ProxyHandler) retryStatus(att *attempt, res *http.Response) bool {
+	if !att.retryable || !att.idempotent || !slices.Contains(ph.Retry.RetryOn, res.StatusCode) {
+		return false
+	}
+	if res.Request.Context().Err() != nil {
+		return false
+	}
+	att.next, att.nextAdm = ph.nextUntriedPeer(res.Request, att.tried)
+	return att.next != nil
+}
+
+// shouldRetryError tells if a failed attempt can be sent again, non idempotent requests
+// only when we are sure the backend never received them
+func shouldRetryError(att *attempt, err error) bool {
+	return att.retryable && (att.idempotent || neverConnected(err))
+}
+
+func (ph *ProxyHandler) nextUntriedPeer(r *http.Request, tried map[*domain.Backend]bool) (*domain.Backend, domain.Admission) {
+	// Strategies don't know about the tried backends, so we ask a few times
+	for range ph.loadBalancer.GetBackends() {
+		peer, err := ph.loadBalancer.GetNextValidPeer(r)
+		if err != nil {
+			return nil, domain.Admission{}
+		}
+		if tried[peer] {
+			continue
+		}
+		// The peer is only taken if its breaker lets the request through
+		if admission, ok := peer.Breaker.Acquire(); ok {
+			return peer, admission
+		}
+	}
+	return nil, domain.Admission{}
+}
+
+// bufferBody reads the body in memory if it is small enough.
+// When it is too big, what was read is put back in front of the rest so the request is still sent once.
+func bufferBody(r *http.Request, limit int64) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if limit <= 0 {
+		limit = DEFAULT_RETRY_BODY_SIZE
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(buf)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	return buf, true
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func neverConnected(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+	"github.com/ibhiyassine/GoKnot/internal/forwarded"
+	"github.com/ibhiyassine/GoKnot/internal/proxyproto"
+	"github.com/ibhiyassine/GoKnot/internal/tlsterm"
+)
+
+// Defaults of the connection pool of each backend, the ones of http.DefaultTransport
+// except for the idle connections, which Go limits to 2 per host
+const (
+	DEFAULT_MAX_IDLE_CONNS        int           = 100
+	DEFAULT_IDLE_CONN_TIMEOUT     time.Duration = 90 * time.Second
+	DEFAULT_DIAL_TIMEOUT          time.Duration = 30 * time.Second
+	DEFAULT_TLS_HANDSHAKE_TIMEOUT time.Duration = 10 * time.Second
+	DEFAULT_KEEP_ALIVE            time.Duration = 30 * time.Second
+)
+
+// UpstreamTLS builds the TLS settings used to reach https:// backends, nil when there are none
+func UpstreamTLS(cfg config.UpstreamTLSConfig) (*tls.Config, error) {
+	if cfg == (config.UpstreamTLSConfig{}) {
+		return nil, nil
+	}
+
+	tlsCfg := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CA != "" {
+		roots, err := tlsterm.LoadCertPool(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("upstream CA: %w", err)
+		}
+		tlsCfg.RootCAs = roots
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("upstream client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+// NewTransport creates the connection pool of one backend
+func NewTransport(tlsCfg *tls.Config, cfg config.TransportConfig) *http.Transport {
+	maxIdle := cfg.MaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = DEFAULT_MAX_IDLE_CONNS
+	}
+	dialer := &net.Dialer{
+		Timeout:   orDefault(time.Duration(cfg.DialTimeout), DEFAULT_DIAL_TIMEOUT),
+		KeepAlive: DEFAULT_KEEP_ALIVE,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     !cfg.DisableHTTP2,
+		MaxIdleConns:          maxIdle,
+		MaxIdleConnsPerHost:   maxIdle, // a transport only ever talks to its backend
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       orDefault(time.Duration(cfg.IdleConnTimeout), DEFAULT_IDLE_CONN_TIMEOUT),
+		TLSHandshakeTimeout:   orDefault(time.Duration(cfg.TLSHandshakeTimeout), DEFAULT_TLS_HANDSHAKE_TIMEOUT),
+		ResponseHeaderTimeout: time.Duration(cfg.ResponseHeaderTimeout),
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if tlsCfg != nil {
+		transport.TLSClientConfig = tlsCfg.Clone()
+	}
+	if cfg.ProxyProtocol > 0 {
+		transport.DialContext = dialProxyProtocol(dialer, cfg.ProxyProtocol)
+		// The header is about one client, a connection can't be reused for another one
+		transport.DisableKeepAlives = true
+		transport.ForceAttemptHTTP2 = false
+	}
+	if cfg.DisableHTTP2 || cfg.ProxyProtocol > 0 {
+		// A non nil empty map is how net/http is told not to upgrade to HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
+
+// dialProxyProtocol starts each connection with a PROXY protocol header giving the client of the request,
+// before TLS for https:// backends. The health checks have no client, their header says so.
+func dialProxyProtocol(dialer *net.Dialer, version int) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		var src, dst *net.TCPAddr
+		if client := forwarded.FromContext(ctx); client != nil {
+			src = client.Addr()
+			// Where the client connected to, the listener of the proxy
+			dst, _ = ctx.Value(http.LocalAddrContextKey).(*net.TCPAddr)
+		}
+		if err := proxyproto.WriteHeader(conn, version, src, dst); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy protocol header: %w", err)
+		}
+		return conn, nil
+	}
+}
+
+func orDefault(d time.Duration, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
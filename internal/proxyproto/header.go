@@ -0,0 +1,190 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// The first 12 bytes of a v2 header, chosen so no other protocol can start with them
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// A v1 header is a single line of at most 107 bytes, \r\n included
+	v1MaxLength = 107
+
+	v2CommandLocal = 0x0
+	v2CommandProxy = 0x1
+	v2FamilyInet   = 0x1
+	v2FamilyInet6  = 0x2
+	v2Stream       = 0x1
+)
+
+// readHeader reads a v1 or v2 header, the addresses are nil when it doesn't give any
+func readHeader(r *bufio.Reader) (src net.Addr, dst net.Addr, err error) {
+	start, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, nil, fmt.Errorf("no PROXY protocol header: %w", err)
+	}
+	switch {
+	case bytes.Equal(start, v2Signature):
+		return readV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readV1(r)
+	}
+	return nil, nil, errors.New("no PROXY protocol header")
+}
+
+// readV1 reads "PROXY TCP4 <src ip> <dst ip> <src port> <dst port>\r\n", or "PROXY UNKNOWN ...\r\n"
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("truncated v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return nil, nil, errors.New("v1 header too long")
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, nil, errors.New("v1 header doesn't end with \\r\\n")
+	}
+
+	fields := strings.Split(text, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// The load balancer doesn't know the client, the rest of the line is ignored
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid v1 header %q", text)
+	}
+	src, err := parseV1Addr(fields[2], fields[4], fields[1] == "TCP6")
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5], fields[1] == "TCP6")
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseV1Addr(ip string, port string, v6 bool) (*net.TCPAddr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is6() != v6 {
+		return nil, fmt.Errorf("invalid v1 address %q", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("invalid v1 port %q", port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+// readV2 reads the binary header: signature, version and command, family, length, then the addresses and TLVs
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, nil, fmt.Errorf("truncated v2 header: %w", err)
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unknown v2 version %d", fixed[12]>>4)
+	}
+	command, family := fixed[12]&0x0f, fixed[13]
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, fmt.Errorf("truncated v2 header: %w", err)
+	}
+
+	switch command {
+	case v2CommandLocal:
+		// Sent by the load balancer for its own checks, the connection is its own
+		return nil, nil, nil
+	case v2CommandProxy:
+	default:
+		return nil, nil, fmt.Errorf("unknown v2 command %d", command)
+	}
+
+	// Only TCP over IPv4 or IPv6 has addresses we can use, the TLVs after them are ignored
+	var size int
+	switch family {
+	case v2FamilyInet<<4 | v2Stream:
+		size = 4
+	case v2FamilyInet6<<4 | v2Stream:
+		size = 16
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, errors.New("v2 addresses truncated")
+	}
+	srcIP, _ := netip.AddrFromSlice(payload[:size])
+	dstIP, _ := netip.AddrFromSlice(payload[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(payload[2*size:])
+	dstPort := binary.BigEndian.Uint16(payload[2*size+2:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort)), nil
+}
+
+// WriteHeader sends a header of the given version (1 or 2) at the start of a connection to a backend.
+// Without both addresses it says the connection is ours (UNKNOWN in v1, LOCAL in v2), like for the health checks.
+func WriteHeader(w io.Writer, version int, src *net.TCPAddr, dst *net.TCPAddr) error {
+	var srcIP, dstIP netip.Addr
+	known := src != nil && dst != nil
+	if known {
+		srcIP, _ = netip.AddrFromSlice(src.IP)
+		dstIP, _ = netip.AddrFromSlice(dst.IP)
+		srcIP, dstIP = srcIP.Unmap(), dstIP.Unmap()
+		if srcIP.Is4() != dstIP.Is4() {
+			// Both must be of the same family, IPv4 is written as IPv4-mapped IPv6
+			srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+		}
+	}
+
+	var header []byte
+	switch version {
+	case 1:
+		if !known {
+			header = []byte("PROXY UNKNOWN\r\n")
+			break
+		}
+		proto := "TCP4"
+		if !srcIP.Is4() {
+			proto = "TCP6"
+		}
+		header = fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, src.Port, dst.Port)
+	case 2:
+		header = append(header, v2Signature...)
+		if !known {
+			header = append(header, 0x20|v2CommandLocal, 0, 0, 0)
+			break
+		}
+		family := byte(v2FamilyInet)
+		if !srcIP.Is4() {
+			family = v2FamilyInet6
+		}
+		addrs := append(srcIP.AsSlice(), dstIP.AsSlice()...)
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+		header = append(header, 0x20|v2CommandProxy, family<<4|v2Stream)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+		header = append(header, addrs...)
+	default:
+		return fmt.Errorf("unknown proxy protocol version %d", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
@@ -0,0 +1,163 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+)
+
+// How long a trusted source has to send its header when the config doesn't say
+const DEFAULT_HEADER_TIMEOUT time.Duration = 5 * time.Second
+
+// Listener reads the PROXY protocol header of the connections coming from the trusted sources,
+// their RemoteAddr is then the one of the client instead of the one of the load balancer
+type Listener struct {
+	net.Listener
+	settings atomic.Pointer[settings]
+}
+
+type settings struct {
+	enabled bool
+	trusted []netip.Prefix // every source is trusted when empty
+	timeout time.Duration
+}
+
+func NewListener(ln net.Listener, cfg config.ProxyProtocolConfig) (*Listener, error) {
+	l := &Listener{Listener: ln}
+	if err := l.SetConfig(cfg); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetConfig applies new settings, the connections already accepted keep the ones they had
+func (l *Listener) SetConfig(cfg config.ProxyProtocolConfig) error {
+	s, err := newSettings(cfg)
+	if err != nil {
+		return err
+	}
+	l.settings.Store(s)
+	return nil
+}
+
+// Validate checks the settings without applying them
+func Validate(cfg config.ProxyProtocolConfig) error {
+	_, err := newSettings(cfg)
+	return err
+}
+
+func newSettings(cfg config.ProxyProtocolConfig) (*settings, error) {
+	s := &settings{enabled: cfg.Enabled, timeout: time.Duration(cfg.HeaderTimeout)}
+	if s.timeout <= 0 {
+		s.timeout = DEFAULT_HEADER_TIMEOUT
+	}
+	for _, entry := range cfg.TrustedSources {
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			return nil, errors.New("Invalid proxy protocol source " + entry + ", use an IP or a CIDR")
+		}
+		s.trusted = append(s.trusted, prefix)
+	}
+	return s, nil
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	s := l.settings.Load()
+	if !s.enabled || !s.trusts(c.RemoteAddr()) {
+		// Anyone else talks to us directly, a header from them would be a lie
+		return c, nil
+	}
+	// The header is read by the goroutine serving the connection, a slow source must not hold the others
+	return &Conn{Conn: c, timeout: s.timeout}, nil
+}
+
+func (s *settings) trusts(addr net.Addr) bool {
+	if len(s.trusted) == 0 {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, _ := netip.AddrFromSlice(tcp.IP)
+	ip = ip.Unmap()
+	for _, prefix := range s.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection starting with a PROXY protocol header, read on the first call to Read or RemoteAddr
+type Conn struct {
+	net.Conn
+	timeout time.Duration
+	once    sync.Once
+	reader  *bufio.Reader
+	src     net.Addr // nil when the header doesn't give one (LOCAL, UNKNOWN)
+	dst     net.Addr
+	err     error
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr is the client given by the header
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr is the address the client connected to, the one of the load balancer
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) readHeader() {
+	c.reader = bufio.NewReader(c.Conn)
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	c.src, c.dst, c.err = readHeader(c.reader)
+	c.Conn.SetReadDeadline(time.Time{})
+	if c.err != nil {
+		log.Printf("[ProxyProtocol] Dropping connection from %s: %v", c.Conn.RemoteAddr(), c.err)
+		c.Conn.Close()
+	}
+}
+
+// parsePrefix reads an IP or a CIDR
+func parsePrefix(entry string) (netip.Prefix, error) {
+	if !strings.Contains(entry, "/") {
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(entry)
+	return prefix.Masked(), err
+}
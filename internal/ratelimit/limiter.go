@@ -0,0 +1,208 @@
+package ratelimit
+
+import (
+	"cmp"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+	"github.com/ibhiyassine/GoKnot/internal/forwarded"
+	"github.com/ibhiyassine/GoKnot/internal/metrics"
+	"github.com/ibhiyassine/GoKnot/internal/requestid"
+)
+
+// Buckets untouched for this long are full again, they are dropped to save memory
+const IDLE_BUCKET_TTL time.Duration = 5 * time.Minute
+
+// Limiter gives every client a token bucket: it holds up to Burst tokens, refilled at Rate per second,
+// and each request takes one. A client with an empty bucket gets a 429.
+type Limiter struct {
+	Name    string
+	Key     string // ip, header:<name> or route
+	cfg     config.RateLimitConfig
+	rate    float64
+	burst   int
+	buckets map[string]*bucket
+	swept   time.Time
+	mux     sync.Mutex
+}
+
+type bucket struct {
+	tokens   float64
+	last     time.Time
+	allowed  uint64
+	rejected uint64
+}
+
+// Bucket is the state of one client, for the admin API
+type Bucket struct {
+	Key      string  `json:"key"`
+	Tokens   float64 `json:"tokens"`
+	Allowed  uint64  `json:"allowed"`
+	Rejected uint64  `json:"rejected"`
+}
+
+func NewLimiter(name string, cfg config.RateLimitConfig) (*Limiter, error) {
+	l := &Limiter{
+		Name:    name,
+		Key:     cfg.Key,
+		cfg:     cfg,
+		buckets: make(map[string]*bucket),
+		swept:   time.Now(),
+	}
+	if l.Key == "" {
+		l.Key = "ip"
+	}
+	if l.Key != "ip" && l.Key != "route" && !strings.HasPrefix(l.Key, "header:") {
+		return nil, errors.New("Unknown rate limit key " + cfg.Key + ", use ip, route or header:<name>")
+	}
+	if err := l.SetLimits(cfg.Rate, cfg.Burst); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reuse returns the running limiter when its config didn't change, so a reload keeps the buckets and the limits
+// adjusted through the admin API. Nil when the config disables rate limiting.
+func Reuse(name string, cfg config.RateLimitConfig, old *Limiter) (*Limiter, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	if old != nil && old.Name == name && old.cfg == cfg {
+		return old, nil
+	}
+	return NewLimiter(name, cfg)
+}
+
+// SetLimits changes the rate and the burst, the buckets keep their tokens
+func (l *Limiter) SetLimits(rate float64, burst int) error {
+	if rate <= 0 {
+		return errors.New("Rate must be positive")
+	}
+	if burst <= 0 {
+		// At least one second worth of requests
+		burst = int(math.Ceil(rate))
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.rate, l.burst = rate, burst
+	return nil
+}
+
+func (l *Limiter) Limits() (float64, int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.rate, l.burst
+}
+
+// Allow takes a token for the client of the request. When there is none left, it answers 429 and returns false.
+// The X-RateLimit-* headers are set either way.
+func (l *Limiter) Allow(w http.ResponseWriter, r *http.Request) bool {
+	key := l.keyOf(r)
+	now := time.Now()
+
+	l.mux.Lock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+		b.allowed++
+	} else {
+		b.rejected++
+	}
+	remaining := int(b.tokens)
+	// Time until the bucket is full again, and until the next token
+	reset := time.Duration((float64(l.burst) - b.tokens) / l.rate * float64(time.Second))
+	retry := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	burst := l.burst
+	l.mux.Unlock()
+
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(burst))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+	if allowed {
+		return true
+	}
+
+	metrics.RateLimited.With(l.Name).Add(1)
+	h.Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retry.Seconds())))))
+	requestid.Error(w, r, "Too many requests", http.StatusTooManyRequests)
+	return false
+}
+
+// Buckets returns the state of the clients, the most rejected first
+func (l *Limiter) Buckets() []Bucket {
+	now := time.Now()
+	l.mux.Lock()
+	list := make([]Bucket, 0, len(l.buckets))
+	for key, b := range l.buckets {
+		tokens := min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		list = append(list, Bucket{Key: key, Tokens: tokens, Allowed: b.allowed, Rejected: b.rejected})
+	}
+	l.mux.Unlock()
+
+	slices.SortFunc(list, func(a, b Bucket) int {
+		if a.Rejected != b.Rejected {
+			return cmp.Compare(b.Rejected, a.Rejected)
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return list
+}
+
+// Reset forgets a client, or every client when the key is empty
+func (l *Limiter) Reset(key string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if key == "" {
+		l.buckets = make(map[string]*bucket)
+		return
+	}
+	delete(l.buckets, key)
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	b.tokens = min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+}
+
+// sweep drops the idle buckets, at most once per TTL
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < IDLE_BUCKET_TTL {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= IDLE_BUCKET_TTL {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *Limiter) keyOf(r *http.Request) string {
+	if l.Key == "route" {
+		// Everyone shares the same bucket
+		return "route"
+	}
+	if name, ok := strings.CutPrefix(l.Key, "header:"); ok {
+		if value := r.Header.Get(name); value != "" {
+			return value
+		}
+		// Clients without the header are limited by their IP
+	}
+	return forwarded.ClientIP(r)
+}
@@ -0,0 +1,151 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+)
+
+const (
+	DEFAULT_HEADER string = "X-Request-ID"
+	DEFAULT_FORMAT string = "uuid"
+	// Incoming IDs longer than this are replaced, they end up in every log line
+	MAX_INCOMING_LENGTH int = 128
+)
+
+// Crockford's base32, the alphabet of ULIDs
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+type idKey struct{}
+
+// Generator gives every request an ID, or keeps the one it came with,
+// so the log lines of the proxy and of the backends can be matched
+type Generator struct {
+	Header string
+	Format string // uuid (v4) or ulid
+}
+
+func New(cfg config.RequestIDConfig) (*Generator, error) {
+	g := &Generator{Header: http.CanonicalHeaderKey(cfg.Header), Format: cfg.Format}
+	if g.Header == "" {
+		g.Header = DEFAULT_HEADER
+	}
+	if g.Format == "" {
+		g.Format = DEFAULT_FORMAT
+	}
+	if g.Format != "uuid" && g.Format != "ulid" {
+		return nil, errors.New("Unknown request id format " + cfg.Format + ", use uuid or ulid")
+	}
+	return g, nil
+}
+
+// Ensure makes sure the request has an ID: it is put in the request header for the backend,
+// in the response header for the client, and in the context of the returned request.
+// A request that already went through Ensure is returned as is.
+func (g *Generator) Ensure(w http.ResponseWriter, r *http.Request) *http.Request {
+	if FromContext(r.Context()) != "" {
+		return r
+	}
+	header := g.HeaderName()
+	id := r.Header.Get(header)
+	if !valid(id) {
+		id = g.generate()
+		r.Header.Set(header, id)
+	}
+	w.Header().Set(header, id)
+	return r.WithContext(context.WithValue(r.Context(), idKey{}, id))
+}
+
+// HeaderName is the header carrying the IDs
+func (g *Generator) HeaderName() string {
+	if g == nil {
+		return DEFAULT_HEADER
+	}
+	return g.Header
+}
+
+// FromContext returns the ID of the request, empty if it has none
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(idKey{}).(string)
+	return id
+}
+
+// Error is http.Error with the ID of the request in the message, for the client to give when reporting it
+func Error(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if id := FromContext(r.Context()); id != "" {
+		msg = fmt.Sprintf("%s (request id %s)", msg, id)
+	}
+	http.Error(w, msg, code)
+}
+
+// Prefix is put in front of the log lines about a request
+func Prefix(r *http.Request) string {
+	if id := FromContext(r.Context()); id != "" {
+		return "[" + id + "] "
+	}
+	return ""
+}
+
+func (g *Generator) generate() string {
+	if g != nil && g.Format == "ulid" {
+		return newULID(time.Now())
+	}
+	return newUUID()
+}
+
+// valid keeps incoming IDs short and printable, clients must not be able to inject anything in the logs
+func valid(id string) bool {
+	if id == "" || len(id) > MAX_INCOMING_LENGTH {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+
+	var out [36]byte
+	hex.Encode(out[0:8], b[0:4])
+	out[8] = '-'
+	hex.Encode(out[9:13], b[4:6])
+	out[13] = '-'
+	hex.Encode(out[14:18], b[6:8])
+	out[18] = '-'
+	hex.Encode(out[19:23], b[8:10])
+	out[23] = '-'
+	hex.Encode(out[24:], b[10:])
+	return string(out[:])
+}
+
+// newULID is 48 bits of milliseconds followed by 80 random bits, 26 characters sorting by time
+func newULID(now time.Time) string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[0:8], uint64(now.UnixMilli())<<16)
+	rand.Read(b[6:])
+
+	// 128 bits in 26 characters of 5 bits, the first one only gets 3
+	hi := binary.BigEndian.Uint64(b[0:8])
+	lo := binary.BigEndian.Uint64(b[8:16])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = ulidAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -0,0 +1,250 @@
+package router
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+	"github.com/ibhiyassine/GoKnot/internal/cors"
+	"github.com/ibhiyassine/GoKnot/internal/domain"
+	"github.com/ibhiyassine/GoKnot/internal/headers"
+	"github.com/ibhiyassine/GoKnot/internal/health"
+	"github.com/ibhiyassine/GoKnot/internal/loadbalancer"
+	"github.com/ibhiyassine/GoKnot/internal/proxy"
+	"github.com/ibhiyassine/GoKnot/internal/ratelimit"
+)
+
+// Defaults of the circuit breaker when only some of its settings are given
+const (
+	DEFAULT_FAILURE_RATIO      float64       = 0.5
+	DEFAULT_BREAKER_MIN_REQS   int           = 10
+	DEFAULT_BREAKER_WINDOW     time.Duration = 10 * time.Second
+	DEFAULT_OPEN_TIMEOUT       time.Duration = 30 * time.Second
+	DEFAULT_HALF_OPEN_REQUESTS int           = 1
+)
+
+// Pool is a named group of backends with everything needed to serve it:
+// its strategy, its health checker and its proxy handler
+type Pool struct {
+	Name     string
+	Strategy string
+	LB       loadbalancer.LoadBalancer
+	Checker  *health.HealthChecker
+	Handler  *proxy.ProxyHandler
+	Limiter  *ratelimit.Limiter // nil without rate limiting
+	CORS     *cors.Policy       // nil leaves CORS to the backends
+	Headers  *headers.Rules     // nil without header rules
+	breaker  config.BreakerConfig
+	declared map[string]config.BackendConfig // backends coming from the config, the others were added through the admin API
+	commit   []func()                        // changes to the carried over backends, applied once the pool is swapped in
+
+	// Every backend gets its own transport, built from these
+	transportCfg config.TransportConfig
+	upstreamTLS  config.UpstreamTLSConfig
+	tlsConfig    *tls.Config            // of the pool
+	tlsConfigs   map[string]*tls.Config // of the backends with their own settings
+}
+
+// NewPool builds the pool described by the config, with the changes made through the admin API (state, can be nil)
+// on top of it. When it replaces a running pool (previous isn't nil), the backends they have in common
+// are carried over with their state.
+func NewPool(cfg config.PoolConfig, previous *Pool, state *PoolState) (*Pool, error) {
+	lb, err := loadbalancer.NewStrategy(cfg.Strategy, cfg.HashKey)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", cfg.Name, err)
+	}
+
+	checker := health.NewHealthChecker(lb, time.Duration(cfg.HealthCheckFreq))
+	checker.Pool = cfg.Name
+	poolCheck := config.HealthCheckConfig{}.Merge(cfg.HealthCheck)
+	checker.Check, err = health.NewCheck(poolCheck)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", cfg.Name, err)
+	}
+
+	handler := proxy.NewProxyHandler(lb)
+	handler.Pool, handler.Strategy = cfg.Name, cfg.Strategy
+	if cfg.StickySessions.Enabled {
+		handler.Affinity = proxy.NewAffinity(cfg.StickySessions.CookieName, cfg.StickySessions.Secret)
+	}
+	if cfg.OutlierDetection.Enabled() {
+		handler.Outliers = health.NewOutlierDetector(lb, cfg.OutlierDetection)
+		handler.Outliers.Pool = cfg.Name
+	}
+	if cfg.Retry.MaxAttempts > 1 {
+		handler.Retry = &proxy.RetryPolicy{
+			MaxAttempts:   cfg.Retry.MaxAttempts,
+			PerTryTimeout: time.Duration(cfg.Retry.PerTryTimeout),
+			Budget:        time.Duration(cfg.Retry.Budget),
+			RetryOn:       cfg.Retry.RetryOn,
+			MaxBodySize:   cfg.Retry.MaxBodySize,
+		}
+	}
+
+	pool := &Pool{
+		Name:     cfg.Name,
+		Strategy: cfg.Strategy,
+		LB:       lb,
+		Checker:  checker,
+		Handler:  handler,
+		breaker:  cfg.CircuitBreaker,
+		declared: make(map[string]config.BackendConfig),
+
+		transportCfg: config.TransportConfig{}.Merge(cfg.Transport),
+		upstreamTLS:  config.UpstreamTLSConfig{}.Merge(cfg.UpstreamTLS),
+		tlsConfigs:   make(map[string]*tls.Config),
+	}
+	if pool.tlsConfig, err = proxy.UpstreamTLS(pool.upstreamTLS); err != nil {
+		return nil, fmt.Errorf("pool %s: %w", cfg.Name, err)
+	}
+	var oldLimiter *ratelimit.Limiter
+	if previous != nil {
+		oldLimiter = previous.Limiter
+	}
+	if pool.Limiter, err = ratelimit.Reuse(cfg.Name, cfg.RateLimit, oldLimiter); err != nil {
+		return nil, fmt.Errorf("pool %s: %w", cfg.Name, err)
+	}
+	if cfg.CORS != nil {
+		if pool.CORS, err = cors.New(*cfg.CORS); err != nil {
+			return nil, fmt.Errorf("pool %s: %w", cfg.Name, err)
+		}
+	}
+	if len(cfg.HeaderRules.Request) > 0 || len(cfg.HeaderRules.Response) > 0 {
+		if pool.Headers, err = headers.New(cfg.HeaderRules); err != nil {
+			return nil, fmt.Errorf("pool %s: %w", cfg.Name, err)
+		}
+		handler.Headers = pool.Headers
+	}
+
+	for _, bc := range cfg.Backends {
+		uri, err := url.Parse(bc.URL)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: invalid backend URL %q: %w", cfg.Name, bc.URL, err)
+		}
+		if _, twice := pool.declared[uri.String()]; twice {
+			return nil, fmt.Errorf("pool %s: backend %s is declared twice", cfg.Name, bc.URL)
+		}
+		pool.declared[uri.String()] = bc
+
+		if bc.HealthCheck != nil {
+			check, err := health.NewCheck(poolCheck.Merge(bc.HealthCheck))
+			if err != nil {
+				return nil, fmt.Errorf("pool %s: backend %s: %w", cfg.Name, bc.URL, err)
+			}
+			checker.SetOverride(uri, check)
+		}
+		if bc.TLS != nil {
+			tlsCfg, err := proxy.UpstreamTLS(pool.upstreamTLS.Merge(bc.TLS))
+			if err != nil {
+				return nil, fmt.Errorf("pool %s: backend %s: %w", cfg.Name, bc.URL, err)
+			}
+			pool.tlsConfigs[uri.String()] = tlsCfg
+		}
+	}
+
+	// What was changed through the admin API goes on top of the config
+	backends, err := state.apply(cfg.Backends, pool.declared)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", cfg.Name, err)
+	}
+	for _, bc := range backends {
+		uri, _ := url.Parse(bc.URL)
+		pool.adopt(uri, bc, previous)
+	}
+
+	return pool, nil
+}
+
+// adopt adds the backend, reusing the one of the previous pool when there is one
+func (p *Pool) adopt(uri *url.URL, bc config.BackendConfig, previous *Pool) {
+	var old *domain.Backend
+	if previous != nil {
+		old, _ = previous.LB.GetBackend(uri)
+	}
+
+	// The breaker and the transport can't be swapped under the requests using them,
+	// the backend is recreated when they change
+	if old != nil && previous.breaker == p.breaker && previous.tlsOf(uri) == p.tlsOf(uri) && previous.transportCfg == p.transportCfg {
+		p.LB.AddBackend(old)
+		// The old pool still serves requests with it until the swap
+		p.commit = append(p.commit, func() {
+			old.SetWeight(bc.Weight)
+			old.SetTags(bc.Tags)
+			old.SetDraining(bc.Draining)
+		})
+		return
+	}
+
+	b := p.AddBackend(uri, bc.Weight, bc.Tags)
+	b.SetDraining(bc.Draining)
+	if old != nil {
+		b.SetAlive(old.IsAlive())
+	}
+}
+
+// AddBackend creates a backend with the settings of the pool and adds it to the load balancer
+func (p *Pool) AddBackend(uri *url.URL, weight int, tags []string) *domain.Backend {
+	b := &domain.Backend{
+		URL:     uri,
+		Alive:   true, // HealthCheck will correct it if false
+		Weight:  weight,
+		Breaker: p.newBreaker(uri),
+	}
+	tlsCfg, ok := p.tlsConfigs[uri.String()]
+	if !ok {
+		tlsCfg = p.tlsConfig
+	}
+	b.Transport = proxy.NewTransport(tlsCfg, p.transportCfg)
+	b.Proxy = proxy.NewBackendProxy(b)
+	b.SetTags(tags)
+	p.LB.AddBackend(b)
+	return b
+}
+
+// RemoveBackend takes the backend out of the load balancer and closes its idle connections
+func (p *Pool) RemoveBackend(uri *url.URL) {
+	b, err := p.LB.GetBackend(uri)
+	if err != nil {
+		return
+	}
+	p.LB.RemoveBackend(uri)
+	b.Close()
+}
+
+// tlsOf returns the upstream TLS settings of a backend
+func (p *Pool) tlsOf(uri *url.URL) config.UpstreamTLSConfig {
+	return p.upstreamTLS.Merge(p.declared[uri.String()].TLS)
+}
+
+func (p *Pool) newBreaker(uri *url.URL) *domain.CircuitBreaker {
+	if !p.breaker.Enabled() {
+		return nil
+	}
+	cb := &domain.CircuitBreaker{
+		Name:           uri.String(),
+		FailureRatio:   p.breaker.FailureRatio,
+		SlowThreshold:  time.Duration(p.breaker.SlowThreshold),
+		MinRequests:    p.breaker.MinRequests,
+		Window:         time.Duration(p.breaker.Window),
+		OpenTimeout:    time.Duration(p.breaker.OpenTimeout),
+		HalfOpenProbes: p.breaker.HalfOpenRequests,
+	}
+	if cb.FailureRatio <= 0 {
+		cb.FailureRatio = DEFAULT_FAILURE_RATIO
+	}
+	if cb.MinRequests <= 0 {
+		cb.MinRequests = DEFAULT_BREAKER_MIN_REQS
+	}
+	if cb.Window <= 0 {
+		cb.Window = DEFAULT_BREAKER_WINDOW
+	}
+	if cb.OpenTimeout <= 0 {
+		cb.OpenTimeout = DEFAULT_OPEN_TIMEOUT
+	}
+	if cb.HalfOpenProbes <= 0 {
+		cb.HalfOpenProbes = DEFAULT_HALF_OPEN_REQUESTS
+	}
+	return cb
+}
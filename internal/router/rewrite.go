@@ -0,0 +1,98 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+)
+
+// Rewrite changes the path of the requests of a route before they reach the pool
+type Rewrite struct {
+	StripPrefix string
+	Regex       *regexp.Regexp
+	Replacement string
+	AddPrefix   string
+}
+
+// Redirect answers the requests of a route instead of proxying them
+type Redirect struct {
+	Code int
+	URL  string // scheme and host, empty to stay on the same host
+}
+
+var redirectCodes = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusSeeOther:          true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+func NewRewrite(cfg config.RewriteConfig) (*Rewrite, error) {
+	rw := &Rewrite{StripPrefix: cfg.StripPrefix, Replacement: cfg.Replacement, AddPrefix: cfg.AddPrefix}
+	if cfg.Regex != "" {
+		re, err := regexp.Compile(cfg.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite regex: %w", err)
+		}
+		rw.Regex = re
+	}
+	return rw, nil
+}
+
+func NewRedirect(cfg config.RedirectConfig) (*Redirect, error) {
+	rd := &Redirect{Code: cfg.Code, URL: strings.TrimSuffix(cfg.URL, "/")}
+	if rd.Code == 0 {
+		rd.Code = http.StatusFound
+	}
+	if !redirectCodes[rd.Code] {
+		return nil, fmt.Errorf("Redirect code %d isn't one of 301, 302, 303, 307 or 308", cfg.Code)
+	}
+	return rd, nil
+}
+
+// Path returns the rewritten path, always starting with a slash
+func (rw *Rewrite) Path(path string) string {
+	if rw == nil {
+		return path
+	}
+	if rw.StripPrefix != "" {
+		path = strings.TrimPrefix(path, rw.StripPrefix)
+	}
+	if rw.Regex != nil {
+		path = rw.Regex.ReplaceAllString(path, rw.Replacement)
+	}
+	path = rw.AddPrefix + path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// Apply returns the request with its path rewritten, the original one is left untouched for the logs
+func (rw *Rewrite) Apply(r *http.Request) *http.Request {
+	if rw == nil {
+		return r
+	}
+	// Only the URL changes, the rest is shared with the original request
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path = rw.Path(r.URL.Path)
+	u.RawPath = "" // encoded again from the new path
+	r2.URL = &u
+	return r2
+}
+
+// Serve answers with a redirect to the path rewritten by rw (nil keeps it), query included
+func (rd *Redirect) Serve(w http.ResponseWriter, r *http.Request, rw *Rewrite) {
+	target := rd.URL + (&url.URL{Path: rw.Path(r.URL.Path)}).EscapedPath()
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, rd.Code)
+}
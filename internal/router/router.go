@@ -0,0 +1,446 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ibhiyassine/GoKnot/internal/accesslog"
+	"github.com/ibhiyassine/GoKnot/internal/config"
+	"github.com/ibhiyassine/GoKnot/internal/cors"
+	"github.com/ibhiyassine/GoKnot/internal/domain"
+	"github.com/ibhiyassine/GoKnot/internal/forwarded"
+	"github.com/ibhiyassine/GoKnot/internal/headers"
+	"github.com/ibhiyassine/GoKnot/internal/ratelimit"
+	"github.com/ibhiyassine/GoKnot/internal/requestid"
+)
+
+// Route holds the conditions a request has to fulfill to be sent to the pool, empty ones are ignored
+type Route struct {
+	Host       string
+	PathPrefix string
+	PathRegex  *regexp.Regexp
+	Methods    []string
+	Headers    map[string]string
+	Pool       *Pool
+	Limiter    *ratelimit.Limiter // replace the ones of the pool, nil to use them
+	CORS       *cors.Policy
+	Rules      *headers.Rules // header rules of the pool followed by the ones of the route, nil if the route has none
+	Rewrite    *Rewrite
+	Redirect   *Redirect // answered instead of being proxied
+}
+
+// Router sits in front of the proxy handlers and picks the pool of each request.
+// Everything built from the config lives in a table, swapped as a whole when the config is reloaded.
+type Router struct {
+	table    atomic.Pointer[table]
+	reload   sync.Mutex
+	stateMux sync.Mutex
+}
+
+type table struct {
+	cfg       *config.ProxyConfig
+	routes    []*Route
+	pools     map[string]*Pool
+	order     []string // pool names in the order of the config, for listing
+	access    *accesslog.Logger
+	accessCfg config.AccessLogConfig
+	ids       *requestid.Generator
+	clients   *forwarded.Resolver
+}
+
+// Build creates the pools and the routes described in the config,
+// along with the changes of the state file, if there is one
+func Build(cfg *config.ProxyConfig) (*Router, error) {
+	var state *State
+	if cfg.StateFile != "" {
+		var err error
+		if state, err = LoadState(cfg.StateFile); err != nil {
+			return nil, err
+		}
+	}
+
+	t, err := buildTable(cfg, nil, state)
+	if err != nil {
+		return nil, err
+	}
+	rt := &Router{}
+	rt.table.Store(t)
+	return rt, nil
+}
+
+// Apply replaces the running pools and routes with the ones of the config.
+// The new ones are fully built before being swapped in, so on error nothing changed.
+// Backends kept by a pool are carried over with their state (health, connections, ejections),
+// and the changes made through the admin API are kept on top of the new config.
+func (rt *Router) Apply(cfg *config.ProxyConfig) error {
+	rt.reload.Lock()
+	defer rt.reload.Unlock()
+
+	old := rt.table.Load()
+	t, err := buildTable(cfg, old, old.state())
+	if err != nil {
+		return err
+	}
+
+	for _, pool := range t.list() {
+		pool.Checker.Start()
+	}
+	rt.table.Store(t)
+	for _, pool := range t.list() {
+		for _, change := range pool.commit {
+			change()
+		}
+		pool.commit = nil
+	}
+	kept := map[*domain.Backend]bool{}
+	for _, pool := range t.list() {
+		for _, b := range pool.LB.GetBackends() {
+			kept[b] = true
+		}
+	}
+	for _, pool := range old.list() {
+		pool.Checker.Stop()
+		// Backends that were removed or recreated won't get new requests
+		for _, b := range pool.LB.GetBackends() {
+			if !kept[b] {
+				b.Close()
+			}
+		}
+	}
+
+	// The old handlers may still be serving requests, their access log is closed once they had time to finish
+	if old.access != t.access {
+		time.AfterFunc(cfg.ShutdownTimeout, func() {
+			old.access.Close()
+		})
+	}
+
+	// Changes that became part of the config don't need to be kept anymore
+	if err := rt.SaveState(); err != nil {
+		log.Printf("[Reload] Failed to save the state file: %v", err)
+	}
+	return nil
+}
+
+// buildTable creates everything described by the config, reusing what it can from the running table (nil at startup)
+func buildTable(cfg *config.ProxyConfig, old *table, state *State) (*table, error) {
+	t := &table{
+		cfg:       cfg,
+		pools:     make(map[string]*Pool),
+		accessCfg: cfg.AccessLog,
+	}
+	ids, err := requestid.New(cfg.RequestID)
+	if err != nil {
+		return nil, err
+	}
+	t.ids = ids
+	if t.clients, err = forwarded.New(cfg.Forwarding); err != nil {
+		return nil, err
+	}
+
+	// One access log shared by all the pools, kept open across reloads if its settings didn't change
+	if old != nil && old.accessCfg == cfg.AccessLog {
+		t.access = old.access
+	} else {
+		access, err := accesslog.New(cfg.AccessLog)
+		if err != nil {
+			return nil, err
+		}
+		t.access = access
+	}
+	fail := func(err error) (*table, error) {
+		if old == nil || t.access != old.access {
+			t.access.Close()
+		}
+		return nil, err
+	}
+
+	for _, pc := range cfg.AllPools() {
+		var previous *Pool
+		if old != nil {
+			previous = old.pools[pc.Name]
+		}
+		pool, err := NewPool(pc, previous, state.pool(pc.Name))
+		if err != nil {
+			return fail(err)
+		}
+		pool.Handler.AccessLog = t.access
+		pool.Handler.RequestIDs = t.ids
+		t.pools[pool.Name] = pool
+		t.order = append(t.order, pool.Name)
+	}
+
+	for i, rc := range cfg.Routes {
+		route := &Route{
+			Host:       strings.ToLower(rc.Host),
+			PathPrefix: rc.PathPrefix,
+			Headers:    rc.Headers,
+			Pool:       t.pools[rc.Pool],
+		}
+		for _, m := range rc.Methods {
+			route.Methods = append(route.Methods, strings.ToUpper(m))
+		}
+		if rc.PathRegex != "" {
+			re, err := regexp.Compile(rc.PathRegex)
+			if err != nil {
+				return fail(fmt.Errorf("route %d: invalid path regex: %w", i, err))
+			}
+			route.PathRegex = re
+		}
+		if route.Pool == nil {
+			return fail(errors.New("Route points to unknown pool " + rc.Pool))
+		}
+		if rc.RateLimit != nil {
+			var oldLimiter *ratelimit.Limiter
+			if old != nil && i < len(old.routes) {
+				oldLimiter = old.routes[i].Limiter
+			}
+			limiter, err := ratelimit.Reuse(fmt.Sprintf("route:%d", i), *rc.RateLimit, oldLimiter)
+			if err != nil {
+				return fail(fmt.Errorf("route %d: %w", i, err))
+			}
+			route.Limiter = limiter
+		}
+		if rc.CORS != nil {
+			policy, err := cors.New(*rc.CORS)
+			if err != nil {
+				return fail(fmt.Errorf("route %d: %w", i, err))
+			}
+			route.CORS = policy
+		}
+		if rc.HeaderRules != nil {
+			rules, err := headers.New(*rc.HeaderRules)
+			if err != nil {
+				return fail(fmt.Errorf("route %d: %w", i, err))
+			}
+			route.Rules = route.Pool.Headers.Then(rules)
+		}
+		if rc.Rewrite != nil {
+			rewrite, err := NewRewrite(*rc.Rewrite)
+			if err != nil {
+				return fail(fmt.Errorf("route %d: %w", i, err))
+			}
+			route.Rewrite = rewrite
+		}
+		if rc.Redirect != nil {
+			redirect, err := NewRedirect(*rc.Redirect)
+			if err != nil {
+				return fail(fmt.Errorf("route %d: %w", i, err))
+			}
+			route.Redirect = redirect
+		}
+		t.routes = append(t.routes, route)
+	}
+
+	if old != nil {
+		for _, pool := range old.list() {
+			if t.pools[pool.Name] == nil {
+				log.Printf("[Reload] Pool %s removed", pool.Name)
+			}
+		}
+	}
+	return t, nil
+}
+
+// Start launches the health checker of every pool
+func (rt *Router) Start() {
+	for _, pool := range rt.Pools() {
+		pool.Checker.Start()
+	}
+}
+
+// Stop ends the health checking of every pool
+func (rt *Router) Stop() {
+	for _, pool := range rt.Pools() {
+		pool.Checker.Stop()
+	}
+}
+
+// Close releases what outlives the requests, once the server stopped serving them
+func (rt *Router) Close() error {
+	return rt.table.Load().access.Close()
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t := rt.table.Load()
+	// The client behind the trusted proxies, for everything keyed by client from here
+	r = t.clients.Resolve(r)
+	// Given here already, so that rejected requests have one too
+	r = t.ids.Ensure(w, r)
+
+	pool, route := t.match(r)
+	if route != nil && route.Rules != nil {
+		r = headers.WithRules(r, route.Rules)
+	}
+	// Logged under the pool even when the router answers the request itself, with the response rules of the route
+	w, done := pool.Handler.Track(w, r)
+	defer done()
+
+	limiter, policy := pool.Limiter, pool.CORS
+	if route != nil {
+		if route.Limiter != nil {
+			limiter = route.Limiter
+		}
+		if route.CORS != nil {
+			policy = route.CORS
+		}
+	}
+
+	// Preflights are answered before being counted, and a 429 carries the CORS headers for the browser to read it
+	if policy != nil {
+		var answered bool
+		if r, answered = policy.Handle(w, r); answered {
+			return
+		}
+	}
+	// Rejected requests never reach the pool, they don't count against the backends
+	if limiter != nil && !limiter.Allow(w, r) {
+		return
+	}
+	if route != nil {
+		if route.Redirect != nil {
+			// Logged through the writer tracked above, no backend is involved
+			route.Redirect.Serve(w, r, route.Rewrite)
+			return
+		}
+		r = route.Rewrite.Apply(r)
+	}
+	pool.Handler.ServeHTTP(w, r)
+}
+
+// Match returns the pool of the first matching route, or the default pool
+func (rt *Router) Match(r *http.Request) *Pool {
+	pool, _ := rt.table.Load().match(r)
+	return pool
+}
+
+// RequestIDs returns the generator giving the requests their ID
+func (rt *Router) RequestIDs() *requestid.Generator {
+	return rt.table.Load().ids
+}
+
+// HeaderRules returns the pool of the request and the header rules it would get, for dry runs
+func (rt *Router) HeaderRules(r *http.Request) (*Pool, *headers.Rules) {
+	pool, route := rt.table.Load().match(r)
+	if route != nil && route.Rules != nil {
+		return pool, route.Rules
+	}
+	return pool, pool.Headers
+}
+
+// match also returns the route that matched, nil for the default pool
+func (t *table) match(r *http.Request) (*Pool, *Route) {
+	for _, route := range t.routes {
+		if route.matches(r) {
+			return route.Pool, route
+		}
+	}
+	return t.pools[config.DEFAULT_POOL], nil
+}
+
+func (rt *Router) Default() *Pool {
+	return rt.Pool(config.DEFAULT_POOL)
+}
+
+// Change runs a change to the backends of a pool, false if the pool doesn't exist.
+// It can't run during a reload, which would otherwise snapshot the pool before the change
+// and build the new one without it.
+func (rt *Router) Change(name string, change func(pool *Pool)) bool {
+	rt.reload.Lock()
+	defer rt.reload.Unlock()
+
+	pool := rt.Pool(name)
+	if pool == nil {
+		return false
+	}
+	change(pool)
+	return true
+}
+
+// Pool returns a pool by its name, nil if it doesn't exist
+func (rt *Router) Pool(name string) *Pool {
+	return rt.table.Load().pools[name]
+}
+
+func (rt *Router) Pools() []*Pool {
+	return rt.table.Load().list()
+}
+
+// Limiters returns the rate limiters of the pools followed by the ones of the routes
+func (rt *Router) Limiters() []*ratelimit.Limiter {
+	t := rt.table.Load()
+	var limiters []*ratelimit.Limiter
+	for _, pool := range t.list() {
+		if pool.Limiter != nil {
+			limiters = append(limiters, pool.Limiter)
+		}
+	}
+	for _, route := range t.routes {
+		if route.Limiter != nil {
+			limiters = append(limiters, route.Limiter)
+		}
+	}
+	return limiters
+}
+
+// Limiter returns a rate limiter by its name (the pool name, or route:<index>), nil if there is none
+func (rt *Router) Limiter(name string) *ratelimit.Limiter {
+	for _, limiter := range rt.Limiters() {
+		if limiter.Name == name {
+			return limiter
+		}
+	}
+	return nil
+}
+
+func (t *table) list() []*Pool {
+	list := make([]*Pool, 0, len(t.order))
+	for _, name := range t.order {
+		list = append(list, t.pools[name])
+	}
+	return list
+}
+
+func (route *Route) matches(r *http.Request) bool {
+	if route.Host != "" && !matchHost(route.Host, r.Host) {
+		return false
+	}
+	if route.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, route.PathPrefix) {
+		return false
+	}
+	if route.PathRegex != nil && !route.PathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(route.Methods) > 0 && !slices.Contains(route.Methods, r.Method) {
+		return false
+	}
+	for name, value := range route.Headers {
+		got, present := r.Header[http.CanonicalHeaderKey(name)]
+		if !present || (value != "" && !slices.Contains(got, value)) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchHost(pattern string, host string) bool {
+	// The Host header can come with the port
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
@@ -0,0 +1,218 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+	"github.com/ibhiyassine/GoKnot/internal/domain"
+)
+
+// State is what was changed through the admin API on top of the config,
+// it is written to the state file so the changes survive restarts
+type State struct {
+	Pools map[string]*PoolState `json:"pools"`
+}
+
+// PoolState holds the differences between the backends of a running pool and the ones of its config
+type PoolState struct {
+	Added    []config.BackendConfig `json:"added,omitempty"`    // not in the config
+	Removed  []string               `json:"removed,omitempty"`  // in the config but removed
+	Weights  map[string]int         `json:"weights,omitempty"`  // of backends from the config
+	Draining map[string]bool        `json:"draining,omitempty"` // of backends from the config
+	Tags     map[string][]string    `json:"tags,omitempty"`     // of backends from the config
+}
+
+// LoadState reads the state file, a missing file is an empty state
+func LoadState(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &State{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// Save writes the state to a temporary file first, a crash while writing can't leave a broken state file
+func (s *State) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *State) pool(name string) *PoolState {
+	if s == nil {
+		return nil
+	}
+	return s.Pools[name]
+}
+
+// apply returns the backends of the config with the changes on top, a nil state changes nothing
+func (ps *PoolState) apply(backends []config.BackendConfig, declared map[string]config.BackendConfig) ([]config.BackendConfig, error) {
+	if ps == nil {
+		return backends, nil
+	}
+
+	list := []config.BackendConfig{}
+	for _, bc := range backends {
+		uri, _ := url.Parse(bc.URL) // already checked by NewPool
+		key := uri.String()
+		if slices.Contains(ps.Removed, key) {
+			continue
+		}
+		if weight, ok := ps.Weights[key]; ok {
+			bc.Weight = weight
+		}
+		if draining, ok := ps.Draining[key]; ok {
+			bc.Draining = draining
+		}
+		if tags, ok := ps.Tags[key]; ok {
+			bc.Tags = tags
+		}
+		list = append(list, bc)
+	}
+
+	added := map[string]bool{}
+	for _, bc := range ps.Added {
+		uri, err := url.Parse(bc.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend URL %q in the state: %w", bc.URL, err)
+		}
+		// The config declares it now, the config wins
+		if _, ok := declared[uri.String()]; ok {
+			continue
+		}
+		// A file written before duplicates were refused may list it twice, the first one is kept
+		if added[uri.String()] {
+			continue
+		}
+		added[uri.String()] = true
+		list = append(list, bc)
+	}
+	return list, nil
+}
+
+// state compares the running backends with the ones of the config
+func (p *Pool) state() *PoolState {
+	ps := &PoolState{
+		Weights:  map[string]int{},
+		Draining: map[string]bool{},
+		Tags:     map[string][]string{},
+	}
+
+	running := map[string]bool{}
+	for _, b := range p.LB.GetBackends() {
+		key := b.URL.String()
+		running[key] = true
+
+		bc, ok := p.declared[key]
+		if !ok {
+			ps.Added = append(ps.Added, config.BackendConfig{
+				URL:      key,
+				Weight:   b.GetWeight(),
+				Tags:     b.GetTags(),
+				Draining: b.IsDraining(),
+			})
+			continue
+		}
+		if b.GetWeight() != max(bc.Weight, domain.DEFAULT_WEIGHT) {
+			ps.Weights[key] = b.GetWeight()
+		}
+		if b.IsDraining() != bc.Draining {
+			ps.Draining[key] = b.IsDraining()
+		}
+		if !slices.Equal(b.GetTags(), bc.Tags) {
+			// Kept even when empty, it means the tags of the config were all removed
+			ps.Tags[key] = append([]string{}, b.GetTags()...)
+		}
+	}
+
+	for key := range p.declared {
+		if !running[key] {
+			ps.Removed = append(ps.Removed, key)
+		}
+	}
+	slices.Sort(ps.Removed)
+	return ps
+}
+
+func (ps *PoolState) empty() bool {
+	return len(ps.Added) == 0 && len(ps.Removed) == 0 && len(ps.Weights) == 0 && len(ps.Draining) == 0 && len(ps.Tags) == 0
+}
+
+// backendConfigs describes the running backends the way the config would
+func (p *Pool) backendConfigs() []config.BackendConfig {
+	list := []config.BackendConfig{}
+	for _, b := range p.LB.GetBackends() {
+		key := b.URL.String()
+		list = append(list, config.BackendConfig{
+			URL:         key,
+			Weight:      b.GetWeight(),
+			Tags:        b.GetTags(),
+			Draining:    b.IsDraining(),
+			HealthCheck: p.declared[key].HealthCheck,
+			TLS:         p.declared[key].TLS,
+		})
+	}
+	return list
+}
+
+// State returns the changes made through the admin API to every pool
+func (rt *Router) State() *State {
+	return rt.table.Load().state()
+}
+
+func (t *table) state() *State {
+	state := &State{Pools: map[string]*PoolState{}}
+	for _, pool := range t.list() {
+		if ps := pool.state(); !ps.empty() {
+			state.Pools[pool.Name] = ps
+		}
+	}
+	return state
+}
+
+// SaveState writes the changes made through the admin API to the state file, if there is one
+func (rt *Router) SaveState() error {
+	rt.stateMux.Lock()
+	defer rt.stateMux.Unlock()
+
+	t := rt.table.Load()
+	if t.cfg.StateFile == "" {
+		return nil
+	}
+	return t.state().Save(t.cfg.StateFile)
+}
+
+// Config returns the running config: the one loaded, with the backends as they are now
+func (rt *Router) Config() *config.ProxyConfig {
+	t := rt.table.Load()
+	cfg := *t.cfg
+
+	cfg.Backends = t.pools[config.DEFAULT_POOL].backendConfigs()
+	cfg.Pools = slices.Clone(cfg.Pools)
+	for i := range cfg.Pools {
+		cfg.Pools[i].Backends = t.pools[cfg.Pools[i].Name].backendConfigs()
+		// Secrets stay out of the export
+		cfg.Pools[i].StickySessions.Secret = ""
+	}
+	cfg.StickySessions.Secret = ""
+	return &cfg
+}
@@ -0,0 +1,174 @@
+package tlsterm
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+)
+
+// How often the certificate files are looked at for changes
+const CERT_WATCH_INTERVAL time.Duration = 10 * time.Second
+
+// CertStore serves the certificate matching the SNI of the client,
+// and reloads the certificates when their files change on disk
+type CertStore struct {
+	entries []*certEntry
+	index   atomic.Pointer[certIndex]
+	mux     sync.Mutex
+}
+
+type certEntry struct {
+	certFile string
+	keyFile  string
+	modified time.Time
+	cert     *tls.Certificate
+}
+
+type certIndex struct {
+	exact    map[string]*tls.Certificate
+	wildcard map[string]*tls.Certificate // by the domain after "*."
+	fallback *tls.Certificate            // for clients without SNI or with an unknown name
+}
+
+func NewCertStore(certs []config.CertificateConfig) (*CertStore, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("TLS needs at least one certificate")
+	}
+
+	store := &CertStore{}
+	for _, c := range certs {
+		entry := &certEntry{certFile: c.CertFile, keyFile: c.KeyFile}
+		if err := entry.load(); err != nil {
+			return nil, err
+		}
+		store.entries = append(store.entries, entry)
+	}
+	store.rebuild()
+	return store, nil
+}
+
+// GetCertificate is meant for tls.Config
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	idx := s.index.Load()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	if cert, ok := idx.exact[name]; ok {
+		return cert, nil
+	}
+	if _, domain, found := strings.Cut(name, "."); found {
+		if cert, ok := idx.wildcard[domain]; ok {
+			return cert, nil
+		}
+	}
+	return idx.fallback, nil
+}
+
+// Watch reloads the certificates whose files changed, until the context is done
+func (s *CertStore) Watch(ctx context.Context) {
+	ticker := time.NewTicker(CERT_WATCH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.reloadChanged()
+		}
+	}
+}
+
+func (s *CertStore) reloadChanged() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	changed := false
+	for _, entry := range s.entries {
+		if !entry.modifiedSince() {
+			continue
+		}
+		// A renewal can be caught halfway (new certificate, old key), the old pair is kept until both match
+		if err := entry.load(); err != nil {
+			log.Printf("[TLS] Failed to reload %s, keeping the previous certificate: %v", entry.certFile, err)
+			continue
+		}
+		log.Printf("[TLS] Reloaded certificate %s", entry.certFile)
+		changed = true
+	}
+	if changed {
+		s.rebuild()
+	}
+}
+
+// rebuild indexes the certificates by the names they are valid for, the first one declared wins
+func (s *CertStore) rebuild() {
+	idx := &certIndex{
+		exact:    map[string]*tls.Certificate{},
+		wildcard: map[string]*tls.Certificate{},
+		fallback: s.entries[0].cert,
+	}
+	for _, entry := range s.entries {
+		for _, name := range names(entry.cert.Leaf) {
+			name = strings.ToLower(name)
+			if domain, ok := strings.CutPrefix(name, "*."); ok {
+				if _, taken := idx.wildcard[domain]; !taken {
+					idx.wildcard[domain] = entry.cert
+				}
+			} else if _, taken := idx.exact[name]; !taken {
+				idx.exact[name] = entry.cert
+			}
+		}
+	}
+	s.index.Store(idx)
+}
+
+func (e *certEntry) load() error {
+	cert, err := tls.LoadX509KeyPair(e.certFile, e.keyFile)
+	if err != nil {
+		return fmt.Errorf("certificate %s: %w", e.certFile, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("certificate %s: %w", e.certFile, err)
+		}
+	}
+	e.cert = &cert
+	e.modified = e.lastModified()
+	return nil
+}
+
+func (e *certEntry) modifiedSince() bool {
+	return e.lastModified().After(e.modified)
+}
+
+// lastModified is the most recent modification of the two files
+func (e *certEntry) lastModified() time.Time {
+	var last time.Time
+	for _, path := range []string{e.certFile, e.keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last
+}
+
+// names are the DNS names of the certificate, or its common name for old ones without any
+func names(leaf *x509.Certificate) []string {
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames
+	}
+	if leaf.Subject.CommonName != "" {
+		return []string{leaf.Subject.CommonName}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package tlsterm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/ibhiyassine/GoKnot/internal/config"
+)
+
+// Header carrying the subject of the verified client certificate to the backends
+const DEFAULT_IDENTITY_HEADER string = "X-Client-Identity"
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ServerConfig builds the TLS settings of the HTTPS listener, the store has to be watched for the certificates to be reloaded
+func ServerConfig(cfg config.TLSConfig) (*tls.Config, *CertStore, error) {
+	store, err := NewCertStore(cfg.Certificates)
+	if err != nil {
+		return nil, nil, err
+	}
+	minVersion, err := ParseVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	suites, err := ParseCipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsCfg := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   suites,
+	}
+
+	if cfg.ClientCA != "" {
+		if tlsCfg.ClientCAs, err = LoadCertPool(cfg.ClientCA); err != nil {
+			return nil, nil, err
+		}
+		switch cfg.ClientAuth {
+		case "", "require":
+			tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, nil, fmt.Errorf("Unknown client_auth %q, use require or optional", cfg.ClientAuth)
+		}
+	}
+	return tlsCfg, store, nil
+}
+
+// ParseVersion turns "1.2" into tls.VersionTLS12, an empty version is TLS 1.2
+func ParseVersion(version string) (uint16, error) {
+	if version == "" {
+		return tls.VersionTLS12, nil
+	}
+	v, ok := versions[version]
+	if !ok {
+		return 0, fmt.Errorf("Unknown TLS version %q", version)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites turns names like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 into their IDs, nil keeps the Go defaults
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := map[string]uint16{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No certificate found in " + path)
+	}
+	return pool, nil
+}
+
+// RedirectHandler sends the clients of the plain HTTP port to the HTTPS one
+func RedirectHandler(tlsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tlsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(tlsPort))
+		}
+		// 308 keeps the method and the body, unlike 301
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// WithIdentity forwards the subject of the verified client certificate in the header.
+// The header is always removed first, clients must not be able to pick their own identity.
+func WithIdentity(header string, next http.Handler) http.Handler {
+	if header == "" {
+		header = DEFAULT_IDENTITY_HEADER
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(header)
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+			r.Header.Set(header, r.TLS.VerifiedChains[0][0].Subject.String())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
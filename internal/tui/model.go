@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"time"
@@ -11,8 +12,6 @@ import (
 	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
-	"github.com/ibhiyassine/GoKnot/internal/domain"
-	"github.com/ibhiyassine/GoKnot/internal/loadbalancer"
 )
 
 /* Model Definition
@@ -29,16 +28,27 @@ type availableActions string
 const (
 	addBackend    availableActions = "Add Backend"
 	removeBackend availableActions = "Remove Backend"
+	drainBackend  availableActions = "Drain Backend" // toggles the draining state
 )
 
+// backendStatus is a backend as the admin API describes it in GET /status
+type backendStatus struct {
+	URL          string `json:"url"`
+	Alive        bool   `json:"alive"`
+	CurrentConns int64  `json:"current_connections"`
+	Weight       int    `json:"weight"`
+	Draining     bool   `json:"draining"`
+	Ejected      bool   `json:"ejected"`
+	Breaker      string `json:"breaker"`
+}
+
 type backendModel struct {
-	lb            loadbalancer.LoadBalancer
-	backends      []*domain.Backend
+	backends      []backendStatus
 	backendCursor int
 }
 
 type adminActionsModel struct {
-	adminPort    int                // For sending the requests of the admin
+	adminURL     string             // Everything goes through the admin API, e.g. http://localhost:3333
 	actions      []availableActions // Action possible as an admin
 	actionCursor int
 }
@@ -56,7 +66,9 @@ type Model struct {
 	focusedSection focus
 }
 
-func InitialModel(lb loadbalancer.LoadBalancer, adminPort int) Model {
+// InitialModel creates the TUI for the GoKnot instance whose admin API is at adminURL,
+// it can run in the same process as the proxy or attach to a running one
+func InitialModel(adminURL string) Model {
 
 	textInput := textinput.New()
 	textInput.Placeholder = "Put the backend URL"
@@ -64,13 +76,10 @@ func InitialModel(lb loadbalancer.LoadBalancer, adminPort int) Model {
 	textInput.Width = 40
 
 	return Model{
-		backendModel: backendModel{
-			backends: lb.GetBackends(),
-			lb:       lb,
-		},
+		backendModel: backendModel{},
 		adminActionsModel: adminActionsModel{
-			actions:   []availableActions{addBackend, removeBackend},
-			adminPort: adminPort,
+			actions:  []availableActions{addBackend, removeBackend, drainBackend},
+			adminURL: strings.TrimSuffix(adminURL, "/"),
 		},
 		popupInput: popupInput{
 			showPopup: false,
@@ -83,7 +92,7 @@ func InitialModel(lb loadbalancer.LoadBalancer, adminPort int) Model {
 func (m Model) Init() tea.Cmd {
 
 	// We want the TUI to refresh automatically every 500 ms
-	return tickCmd()
+	return tea.Batch(m.fetchStatusCmd(), tickCmd())
 }
 
 // Helper types
@@ -103,14 +112,21 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	// =========================================================================
 	switch msg := msg.(type) {
 
-	// The Heartbeat: Always update data and restart timer
+	// The Heartbeat: Always ask for fresh data and restart timer
 	case tickMsg:
-		m.backends = m.lb.GetBackends()
+		return m, tea.Batch(m.fetchStatusCmd(), tickCmd())
+
+	case statusMsg:
+		if msg.err != nil {
+			m.feedbackMsg = "Error: can't reach the admin API: " + msg.err.Error()
+			return m, nil
+		}
+		m.backends = msg.backends
 		// Safety check for cursor bounds
 		if m.backendCursor >= len(m.backends) && len(m.backends) > 0 {
 			m.backendCursor = len(m.backends) - 1
 		}
-		return m, tickCmd()
+		return m, nil
 
 	// The API Feedback: Always show success/error
 	case apiResultMsg:
@@ -119,7 +135,7 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		} else {
 			m.feedbackMsg = "Success: " + msg.message
 			// FORCE REFRESH: Immediately update the list so we don't have to wait 500ms
-			m.backends = m.lb.GetBackends()
+			return m, m.fetchStatusCmd()
 		}
 	}
 
@@ -160,7 +176,7 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 func (m Model) handleKeyboardInput(key string) (Model, tea.Cmd) {
 	switch key {
-	case "esc", "q":
+	case "esc", "q", "ctrl+c":
 		return m, tea.Quit
 
 	case "tab":
@@ -207,11 +223,16 @@ func (m Model) executeMenuAction() (Model, tea.Cmd) {
 	case removeBackend:
 		// We will remove the selected backend from the table
 		if len(m.backends) > 0 {
-			targetURL := m.backends[m.backendCursor].URL.String()
+			targetURL := m.backends[m.backendCursor].URL
 			// Delete
 			return m, m.deleteBackendCmd(targetURL)
 
 		}
+	case drainBackend:
+		if len(m.backends) > 0 {
+			target := m.backends[m.backendCursor]
+			return m, m.drainBackendCmd(target.URL, !target.Draining)
+		}
 	}
 
 	return m, nil
@@ -223,6 +244,39 @@ type apiResultMsg struct {
 	err     error
 }
 
+type statusMsg struct {
+	backends []backendStatus
+	err      error
+}
+
+func (m Model) fetchStatusCmd() tea.Cmd {
+	return func() tea.Msg {
+		client := &http.Client{Timeout: 2 * time.Second}
+		resp, err := client.Get(m.adminURL + "/status")
+		if err != nil {
+			return statusMsg{err: err}
+		}
+		defer resp.Body.Close()
+
+		var status struct {
+			Backends []backendStatus `json:"backends"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			return statusMsg{err: err}
+		}
+		return statusMsg{backends: status.Backends}
+	}
+}
+
+// checkResponse turns the error answers of the admin API into an error
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
 func (m Model) addBackendCmd(url string) tea.Cmd {
 	return func() tea.Msg {
 		request := map[string]string{"url": url}
@@ -232,12 +286,15 @@ func (m Model) addBackendCmd(url string) tea.Cmd {
 		}
 
 		// Send the post request to the admin API
-		adminEndpoint := fmt.Sprintf("http://localhost:%d/backends", m.adminPort)
+		adminEndpoint := m.adminURL + "/backends"
 		resp, err := http.Post(adminEndpoint, "application/json", bytes.NewBuffer(jsonBody))
 		if err != nil {
 			return apiResultMsg{err: err}
 		}
 		defer resp.Body.Close()
+		if err := checkResponse(resp); err != nil {
+			return apiResultMsg{err: err}
+		}
 
 		return apiResultMsg{message: "Added " + url}
 	}
@@ -253,7 +310,7 @@ func (m Model) deleteBackendCmd(url string) tea.Cmd {
 			return apiResultMsg{err: err}
 		}
 
-		adminEndpoint := fmt.Sprintf("http://localhost:%d/backends", m.adminPort)
+		adminEndpoint := m.adminURL + "/backends"
 		req, err := http.NewRequest(http.MethodDelete, adminEndpoint, bytes.NewBuffer(jsonBody))
 
 		if err != nil {
@@ -268,11 +325,45 @@ func (m Model) deleteBackendCmd(url string) tea.Cmd {
 			return apiResultMsg{err: err}
 		}
 		defer resp.Body.Close()
+		if err := checkResponse(resp); err != nil {
+			return apiResultMsg{err: err}
+		}
 
 		return apiResultMsg{message: "Removed " + url}
 	}
 }
 
+func (m Model) drainBackendCmd(url string, draining bool) tea.Cmd {
+	return func() tea.Msg {
+		request := map[string]any{"url": url, "draining": draining}
+		jsonBody, err := json.Marshal(request)
+		if err != nil {
+			return apiResultMsg{err: err}
+		}
+
+		adminEndpoint := m.adminURL + "/backends"
+		req, err := http.NewRequest(http.MethodPatch, adminEndpoint, bytes.NewBuffer(jsonBody))
+		if err != nil {
+			return apiResultMsg{err: err}
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return apiResultMsg{err: err}
+		}
+		defer resp.Body.Close()
+		if err := checkResponse(resp); err != nil {
+			return apiResultMsg{err: err}
+		}
+
+		if draining {
+			return apiResultMsg{message: "Draining " + url}
+		}
+		return apiResultMsg{message: "Back in rotation " + url}
+	}
+}
+
 // NOTE: This code is generated by AI for now because i don't understant anything about UI/UX and designing
 // Of course i will understand the code
 // =============================================================================
@@ -298,8 +389,9 @@ var (
 			Foreground(lipgloss.Color("240")) // Grey
 
 	// Status indicators
-	statusAlive = lipgloss.NewStyle().Foreground(lipgloss.Color("42")) // Green
-	statusDead  = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))  // Red
+	statusAlive   = lipgloss.NewStyle().Foreground(lipgloss.Color("42"))  // Green
+	statusDead    = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))   // Red
+	statusEjected = lipgloss.NewStyle().Foreground(lipgloss.Color("214")) // Orange
 )
 
 // =============================================================================
@@ -326,8 +418,8 @@ func (m Model) View() string {
 	s.WriteString("BACKENDS:\n")
 
 	// Header Row
-	s.WriteString(fmt.Sprintf("  %-30s | %-10s | %s\n", "URL", "Status", "Conns"))
-	s.WriteString("  ------------------------------------------------------------\n")
+	s.WriteString(fmt.Sprintf("  %-30s | %-10s | %-6s | %s\n", "URL", "Status", "Weight", "Conns"))
+	s.WriteString("  ---------------------------------------------------------------------\n")
 
 	if len(m.backends) == 0 {
 		s.WriteString("  (No backends found)\n")
@@ -355,16 +447,28 @@ func (m Model) View() string {
 		// Status coloring
 		status := "ALIVE"
 		stStyle := statusAlive
-		if !b.IsAlive() {
+		if !b.Alive {
 			status = "DEAD"
 			stStyle = statusDead
+		} else if b.Draining {
+			status = "DRAINING"
+			stStyle = statusEjected
+		} else if b.Ejected {
+			// Alive for the health checker, but taken out of rotation because of its live traffic
+			status = "EJECTED"
+			stStyle = statusEjected
+		} else if b.Breaker != "" && b.Breaker != "closed" {
+			// The circuit breaker holds back the traffic
+			status = strings.ToUpper(b.Breaker)
+			stStyle = statusEjected
 		}
 
 		// Render the row
-		s.WriteString(fmt.Sprintf("%s%s | %s | %d\n",
+		s.WriteString(fmt.Sprintf("%s%s | %s | %-6d | %d\n",
 			rowStyle.Render(cursor),
-			rowStyle.Render(fmt.Sprintf("%-30s", b.URL.String())),
+			rowStyle.Render(fmt.Sprintf("%-30s", b.URL)),
 			stStyle.Render(fmt.Sprintf("%-10s", status)),
+			b.Weight,
 			b.CurrentConns,
 		))
 	}
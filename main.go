@@ -1,88 +1,185 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/ibhiyassine/GoKnot/internal/admin"
 	"github.com/ibhiyassine/GoKnot/internal/config"
-	"github.com/ibhiyassine/GoKnot/internal/health"
-	"github.com/ibhiyassine/GoKnot/internal/loadbalancer"
-	"github.com/ibhiyassine/GoKnot/internal/proxy"
+	"github.com/ibhiyassine/GoKnot/internal/proxyproto"
+	"github.com/ibhiyassine/GoKnot/internal/router"
+	"github.com/ibhiyassine/GoKnot/internal/tlsterm"
 	"github.com/ibhiyassine/GoKnot/internal/tui"
 )
 
-var pool = &loadbalancer.ServerPool{}
-var Strats = map[string]loadbalancer.LoadBalancer{
-	"round_robin":      loadbalancer.NewRoundRobin(pool),
-	"least_connection": loadbalancer.NewLeastConnections(pool),
-}
+var (
+	configPath = flag.String("config", "config.json", "Path of the configuration file")
+	headless   = flag.Bool("headless", false, "Run as a daemon without the TUI, logging JSON to stdout")
+	attach     = flag.String("attach", "", "Only run the TUI, attached to the admin API of a running instance (e.g. http://localhost:3333)")
+	watch      = flag.Bool("watch", false, "Reload the configuration whenever the file is modified")
+)
 
 func main() {
 	// This is the entry point for the reverse proxy
+	flag.Parse()
+
+	// SIGINT and SIGTERM stop the proxy gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The TUI alone, the proxy runs in another process
+	if *attach != "" {
+		runTUI(ctx, *attach)
+		return
+	}
+
+	// Loading configuration
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Error loading configuration of reverse proxy: %v", err)
+	}
+	daemon := *headless || cfg.Headless
 
 	//NOTE: This logging is completely written by AI, i like it :)
 	// =========================================================================
-	// 1. Setup Logging (File + Console)
+	// 1. Setup Logging (File, or stdout as JSON when headless)
 	// =========================================================================
-	if err := os.MkdirAll("logs", 0755); err != nil {
-		log.Fatalf("Failed to create logs directory: %v", err)
+	if daemon {
+		// Every log.Printf of the code base goes through slog and comes out as a JSON line
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+	} else {
+		if err := os.MkdirAll("logs", 0755); err != nil {
+			log.Fatalf("Failed to create logs directory: %v", err)
+		}
+
+		logFile, err := os.OpenFile("logs/goknot.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		defer logFile.Close()
+
+		// The terminal belongs to the TUI, logs go to the file
+		log.SetOutput(logFile)
 	}
+	log.Println("Initializing GoKnot Load Balancer...")
 
-	logFile, err := os.OpenFile("logs/goknot.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	// Initialize the pools (each one has its own load balancer and health checker) and the routes to them
+	rt, err := router.Build(cfg)
 	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
+		log.Fatalf("Error initializing the pools: %v", err)
 	}
-	defer logFile.Close()
 
-	// Write to both Terminal and File
-	log.SetOutput(logFile)
-	log.Println("Initializing GoKnot Load Balancer...")
+	// Start healthcheckers and admin api
+	admin := admin.NewAdminServer(rt)
 
-	// Loading configuration
-	cfg, err := config.LoadConfig("config.json")
-	if err != nil {
-		log.Fatal("Error loading configuration of reverse proxy")
+	rt.Start()
+
+	// With mTLS the backends are told who the client is
+	handler := http.Handler(rt)
+	if cfg.TLS.ClientCA != "" {
+		handler = tlsterm.WithIdentity(cfg.TLS.IdentityHeader, rt)
 	}
 
-	// Initialize load Balancer
-	lb := Strats[cfg.Strategy]
-	if lb == nil {
-		log.Fatal("Error loading the correct strategy")
+	// The plain port serves the proxy too, unless it only redirects to HTTPS
+	plain := handler
+	var tlsServer *http.Server
+	var tlsLn *proxyproto.Listener
+	if cfg.TLS.Port > 0 {
+		tlsCfg, certs, err := tlsterm.ServerConfig(cfg.TLS)
+		if err != nil {
+			log.Fatalf("Error setting up TLS: %v", err)
+		}
+		go certs.Watch(ctx)
+
+		tlsLn, err = listen(cfg.TLS.Port, cfg.ProxyProtocol)
+		if err != nil {
+			log.Fatalf("HTTPS server failed: %v", err)
+		}
+		tlsServer = serveProxy(tlsLn, handler, tlsCfg)
+		log.Printf("HTTPS server listening on :%d", cfg.TLS.Port)
+
+		if cfg.TLS.RedirectHTTP {
+			plain = tlsterm.RedirectHandler(cfg.TLS.Port)
+		}
 	}
 
-	// Start healthchecker and admin api
-	checker := health.NewHealthChecker(lb, cfg.HealthCheckFreq)
-	admin := admin.NewAdminServer(lb)
+	serverAddr := fmt.Sprintf(":%d", cfg.Port)
+	ln, err := listen(cfg.Port, cfg.ProxyProtocol)
+	if err != nil {
+		log.Fatalf("Proxy server failed: %v", err)
+	}
+	server := serveProxy(ln, plain, nil)
+	log.Printf("Proxy server listening on %s (Admin listening on :%d)", serverAddr, cfg.AdminPort)
 
-	checker.Start()
+	// SIGHUP, POST /reload and -watch apply the new config without dropping connections
+	rl := &reloader{path: *configPath, cfg: cfg, rt: rt, handler: plain, server: server, listener: ln, tlsServer: tlsServer, tlsListener: tlsLn, admin: admin}
+	admin.Reload = rl.Reload
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			rl.Reload()
+		}
+	}()
+	if *watch {
+		go rl.watch(ctx)
+	}
 
-	// We just run the admin and don't care of it halting, no need for wait group
+	// We just run the admin, it is stopped with the proxy at shutdown
 	go func() {
 		//NOTE: admin listens in port 3333
 		admin.Start(":" + strconv.Itoa(cfg.AdminPort))
 	}()
 
-	proxyHandler := proxy.NewProxyHandler(lb)
-
-	serverAddr := fmt.Sprintf(":%d", cfg.Port)
-	go func() {
+	if daemon {
+		<-ctx.Done()
+	} else {
+		// The TUI goes through the admin API like any other client
+		// Quitting it or receiving a signal both lead to the shutdown
+		runTUI(ctx, fmt.Sprintf("http://localhost:%d", cfg.AdminPort))
+	}
 
-		err = http.ListenAndServe(serverAddr, proxyHandler)
-		if err != nil {
-			log.Fatal("Proxy server failed...")
-		}
-	}()
-	log.Printf("Proxy server listening on %s (Admin listening on :%d)", serverAddr, cfg.AdminPort)
+	signal.Stop(hup)
+	servers, cfg := rl.current()
+	shutdown(servers, admin, rt, cfg)
+}
 
-	// Start the TUI
-	p := tea.NewProgram(tui.InitialModel(lb, cfg.AdminPort))
-	if _, err := p.Run(); err != nil {
+func runTUI(ctx context.Context, adminURL string) {
+	p := tea.NewProgram(tui.InitialModel(adminURL), tea.WithContext(ctx))
+	if _, err := p.Run(); err != nil && !errors.Is(err, tea.ErrProgramKilled) && !errors.Is(err, tea.ErrInterrupted) {
 		fmt.Printf("Alas, there's been an error: %v", err)
 		os.Exit(1)
 	}
 }
+
+// shutdown stops accepting connections and waits for the in-flight requests, up to the configured timeout
+func shutdown(servers []*http.Server, admin *admin.AdminServer, rt *router.Router, cfg *config.ProxyConfig) {
+	log.Printf("Shutting down, waiting up to %v for in-flight requests...", cfg.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	rt.Stop()
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Proxy server didn't shut down cleanly: %v", err)
+		}
+	}
+	if err := admin.Shutdown(ctx); err != nil {
+		log.Printf("Admin server didn't shut down cleanly: %v", err)
+	}
+	if err := rt.Close(); err != nil {
+		log.Printf("Failed to close the access log: %v", err)
+	}
+	log.Println("GoKnot stopped")
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ibhiyassine/GoKnot/internal/admin"
+	"github.com/ibhiyassine/GoKnot/internal/config"
+	"github.com/ibhiyassine/GoKnot/internal/proxyproto"
+	"github.com/ibhiyassine/GoKnot/internal/router"
+)
+
+// How often the config file is looked at with -watch
+const WATCH_INTERVAL time.Duration = 2 * time.Second
+
+// reloader applies a new version of the config file to the running proxy,
+// it is triggered by SIGHUP, POST /reload on the admin API, or a change of the file with -watch
+type reloader struct {
+	path        string
+	cfg         *config.ProxyConfig
+	rt          *router.Router
+	handler     http.Handler // served on the plain port
+	server      *http.Server
+	listener    *proxyproto.Listener
+	tlsServer   *http.Server // nil without TLS
+	tlsListener *proxyproto.Listener
+	admin       *admin.AdminServer
+	mux         sync.Mutex
+}
+
+// Reload re-reads the config file and applies what changed, the changes needing a restart are only reported.
+// If the new config is invalid, or a new port can't be bound, the running state is left as it was and the error is returned.
+func (rl *reloader) Reload() (changes []string, pending []string, err error) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	next, err := config.LoadConfig(rl.path)
+	if err != nil {
+		log.Printf("[Reload] Invalid config, keeping the running one: %v", err)
+		return nil, nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	// The listeners and the TUI keep what they started with, so does the config we hold,
+	// the pending changes are reported again on every reload until the restart
+	pending = config.Pending(rl.cfg, next)
+	for _, change := range pending {
+		log.Printf("[Reload] Pending: %s", change)
+	}
+	next.Headless = rl.cfg.Headless
+	next.TLS = rl.cfg.TLS
+
+	changes = config.Diff(rl.cfg, next)
+	if len(changes) == 0 {
+		if len(pending) == 0 {
+			log.Println("[Reload] Config didn't change")
+		}
+		return nil, pending, nil
+	}
+
+	if err := proxyproto.Validate(next.ProxyProtocol); err != nil {
+		log.Printf("[Reload] Invalid config, keeping the running one: %v", err)
+		return nil, nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	// New ports are bound before anything is applied, a port already in use must not leave us half reloaded
+	var proxyLn *proxyproto.Listener
+	var adminLn net.Listener
+	closeProxyLn := func() {
+		// A nil *Listener wouldn't be a nil net.Listener for closeListener
+		if proxyLn != nil {
+			proxyLn.Close()
+		}
+	}
+	if next.Port != rl.cfg.Port {
+		if proxyLn, err = listen(next.Port, next.ProxyProtocol); err != nil {
+			log.Printf("[Reload] Can't listen on the new port, keeping the running config: %v", err)
+			return nil, nil, err
+		}
+	}
+	if next.AdminPort != rl.cfg.AdminPort {
+		if adminLn, err = net.Listen("tcp", fmt.Sprintf(":%d", next.AdminPort)); err != nil {
+			closeProxyLn()
+			log.Printf("[Reload] Can't listen on the new admin port, keeping the running config: %v", err)
+			return nil, nil, err
+		}
+	}
+
+	if err := rl.rt.Apply(next); err != nil {
+		closeProxyLn()
+		closeListener(adminLn)
+		log.Printf("[Reload] Failed to apply the config, keeping the running one: %v", err)
+		return nil, nil, err
+	}
+
+	if proxyLn != nil {
+		// The old listener stops accepting, its in-flight requests finish on their own
+		previous := rl.server
+		rl.server = serveProxy(proxyLn, rl.handler, nil)
+		rl.listener = proxyLn
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), next.ShutdownTimeout)
+			defer cancel()
+			previous.Shutdown(ctx)
+		}()
+	}
+	if adminLn != nil {
+		go rl.admin.Serve(adminLn)
+	}
+	// Validated above, the next connections read the headers with the new settings
+	rl.listener.SetConfig(next.ProxyProtocol)
+	if rl.tlsListener != nil {
+		rl.tlsListener.SetConfig(next.ProxyProtocol)
+	}
+	rl.cfg = next
+
+	for _, change := range changes {
+		log.Printf("[Reload] %s", change)
+	}
+	return changes, pending, nil
+}
+
+// current returns the proxy servers and the config in use
+func (rl *reloader) current() ([]*http.Server, *config.ProxyConfig) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+	servers := []*http.Server{rl.server}
+	if rl.tlsServer != nil {
+		servers = append(servers, rl.tlsServer)
+	}
+	return servers, rl.cfg
+}
+
+// watch reloads the config whenever the file is modified, until the context is done
+func (rl *reloader) watch(ctx context.Context) {
+	last := modTime(rl.path)
+	ticker := time.NewTicker(WATCH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			mod := modTime(rl.path)
+			if mod.Equal(last) {
+				continue
+			}
+			last = mod
+			log.Printf("[Reload] %s was modified", rl.path)
+			rl.Reload()
+		}
+	}
+}
+
+// serveProxy starts the proxy server on the listener, over TLS when tlsCfg isn't nil
+func serveProxy(ln net.Listener, handler http.Handler, tlsCfg *tls.Config) *http.Server {
+	server := &http.Server{Addr: ln.Addr().String(), Handler: handler, TLSConfig: tlsCfg}
+	go func() {
+		var err error
+		if tlsCfg != nil {
+			// The certificates come from TLSConfig.GetCertificate
+			err = server.ServeTLS(ln, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal("Proxy server failed...")
+		}
+	}()
+	return server
+}
+
+// listen binds a proxy port, reading the PROXY protocol headers when it is enabled
+func listen(port int, cfg config.ProxyProtocolConfig) (*proxyproto.Listener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	pln, err := proxyproto.NewListener(ln, cfg)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return pln, nil
+}
+
+func closeListener(ln net.Listener) {
+	if ln != nil {
+		ln.Close()
+	}
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}